@@ -0,0 +1,134 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+)
+
+// Action is the kind of access an Authorizer is asked for
+type Action string
+
+const (
+	ActionRead     Action = "read"     // rendered images and cache files
+	ActionMeta     Action = "meta"     // metadata, srcset manifests and cache entries
+	ActionUpload   Action = "upload"   // insert or replace the image of a link
+	ActionDelete   Action = "delete"   // remove the image of a link
+	ActionOriginal Action = "original" // download the uploaded original
+	ActionLink     Action = "link"     // attach an existing image to a link
+)
+
+// Errors an Authorizer returns to deny access. ErrImageHidden answers 404, so the
+// existence of private images is not revealed. All other errors answer 403.
+var (
+	ErrAccessDenied = errors.New("access denied")
+	ErrImageHidden  = errors.New("image not found")
+)
+
+// ImageLink identifies an image and the entity it belongs to. Requests addressing
+// an image by uuid get the link the image was first uploaded to, the context fields
+// are empty if the image has no link. ImageUuid is empty when uploading into a link
+// without an image.
+type ImageLink struct {
+	ImageUuid   string
+	Context     string
+	ContextUuid string
+	Identifier  string
+	UserUuid    string // set for upload, link and delete, resolved by Pluto.ResolveUser
+}
+
+// Authorizer decides whether a request may perform an action on an image. Without
+// an Authorizer reading is public, and upload, link, delete and original downloads are denied.
+type Authorizer interface {
+	Authorize(gc *gin.Context, action Action, link ImageLink) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(gc *gin.Context, action Action, link ImageLink) error
+
+func (f AuthorizerFunc) Authorize(gc *gin.Context, action Action, link ImageLink) error {
+	return f(gc, action, link)
+}
+
+// authorize consults the Authorizer, it writes the error response if access is denied
+func (pluto *Pluto) authorize(gc *gin.Context, apiRequest *grains_api.Request, action Action, link ImageLink) bool {
+	authorizer := pluto.Authorizer
+	if authorizer == nil {
+		switch action {
+		case ActionRead, ActionMeta:
+			return true
+		}
+		apiRequest.Error(http.StatusForbidden, "insufficient permissions")
+		return false
+	}
+
+	if err := authorizer.Authorize(gc, action, link); err != nil {
+		if errors.Is(err, ErrImageHidden) {
+			apiRequest.Error(http.StatusNotFound, "image not found")
+			return false
+		}
+		apiRequest.Error(http.StatusForbidden, "insufficient permissions")
+		return false
+	}
+
+	return true
+}
+
+// authorizeImage resolves the link of an image addressed by uuid and consults the Authorizer
+func (pluto *Pluto) authorizeImage(gc *gin.Context, apiRequest *grains_api.Request, action Action, imageUuid string) bool {
+	link := ImageLink{ImageUuid: imageUuid}
+
+	// Public reads need no lookup
+	if pluto.Authorizer != nil {
+		var err error
+		link, err = pluto.loadImageLink(gc.Request.Context(), imageUuid)
+		if err != nil {
+			apiRequest.DatabaseError()
+			return false
+		}
+	}
+
+	return pluto.authorize(gc, apiRequest, action, link)
+}
+
+// allowImage reports whether an action on an image is granted without writing a response
+func (pluto *Pluto) allowImage(gc *gin.Context, action Action, imageUuid string) (bool, error) {
+	if pluto.Authorizer == nil {
+		return action == ActionRead || action == ActionMeta, nil
+	}
+
+	link, err := pluto.loadImageLink(gc.Request.Context(), imageUuid)
+	if err != nil {
+		return false, err
+	}
+
+	return pluto.Authorizer.Authorize(gc, action, link) == nil, nil
+}
+
+// loadImageLink returns the first link of an image, only ImageUuid is set if there is none
+func (pluto *Pluto) loadImageLink(ctx context.Context, imageUuid string) (ImageLink, error) {
+	link := ImageLink{ImageUuid: imageUuid}
+
+	if validateUuid(imageUuid) != nil {
+		return link, nil
+	}
+
+	query := fmt.Sprintf(
+		`SELECT context, context_uuid::text, identifier
+		 FROM %s.pluto_image_link
+		 WHERE pluto_image_uuid = $1::uuid
+		 ORDER BY id
+		 LIMIT 1`,
+		pluto.DbSchema)
+	err := pluto.DbPool.QueryRow(ctx, query, imageUuid).Scan(&link.Context, &link.ContextUuid, &link.Identifier)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return link, err
+	}
+
+	return link, nil
+}
@@ -0,0 +1,118 @@
+package pluto
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// CachePurgeFilter selects the cache files to purge. Filters are combined, an
+// empty filter purges the whole cache.
+type CachePurgeFilter struct {
+	ImageUuid   string
+	Context     string
+	ContextUuid string        // only together with Context
+	OlderThan   time.Duration // render age, cache hits keep the modification time
+	DryRun      bool
+}
+
+// CachePurgeResult holds the number of cache files and pluto_cache rows purged
+type CachePurgeResult struct {
+	Files int `json:"files"`
+	Rows  int `json:"rows"`
+}
+
+// PurgeCache deletes rendered cache files and their pluto_cache rows
+func (pluto *Pluto) PurgeCache(ctx context.Context, filter CachePurgeFilter) (CachePurgeResult, error) {
+	var result CachePurgeResult
+
+	// Restrict to the images of a single image or context
+	var imageUuids map[string]bool
+	if filter.ImageUuid != "" {
+		imageUuids = map[string]bool{filter.ImageUuid: true}
+	}
+	if filter.Context != "" {
+		uuids, err := pluto.contextImageUuids(ctx, filter.Context, filter.ContextUuid)
+		if err != nil {
+			return result, err
+		}
+		if imageUuids != nil {
+			// Both given, the image must belong to the context
+			if !uuids[filter.ImageUuid] {
+				return result, nil
+			}
+		} else {
+			imageUuids = uuids
+		}
+	}
+
+	var objects []StorageObject
+	if imageUuids == nil {
+		all, err := pluto.CacheStorage.List(ctx, "")
+		if err != nil {
+			return result, fmt.Errorf("List failed: %w", err)
+		}
+		objects = all
+	} else {
+		for imageUuid := range imageUuids {
+			list, err := pluto.CacheStorage.List(ctx, imageUuid+"_")
+			if err != nil {
+				return result, fmt.Errorf("List failed: %w", err)
+			}
+			objects = append(objects, list...)
+		}
+	}
+
+	cutoff := time.Now().Add(-filter.OlderThan)
+	for _, object := range objects {
+		if filter.OlderThan > 0 && object.ModTime.After(cutoff) {
+			continue
+		}
+
+		result.Files++
+		if filter.DryRun {
+			continue
+		}
+
+		if err := pluto.CacheStorage.Delete(ctx, object.Key); err != nil {
+			return result, fmt.Errorf("Failed to delete %s: %w", object.Key, err)
+		}
+
+		// The file name is the receipt with the image type as extension
+		ext := path.Ext(object.Key)
+		query := fmt.Sprintf(`DELETE FROM %s.pluto_cache WHERE receipt = $1 AND mime_type = $2`, pluto.DbSchema)
+		tag, err := pluto.DbPool.Exec(ctx, query, strings.TrimSuffix(object.Key, ext), strings.TrimPrefix(ext, "."))
+		if err != nil {
+			return result, fmt.Errorf("Failed to delete pluto_cache row of %s: %w", object.Key, err)
+		}
+		result.Rows += int(tag.RowsAffected())
+	}
+
+	return result, nil
+}
+
+// contextImageUuids returns the uuids of all images linked in a context
+func (pluto *Pluto) contextImageUuids(ctx context.Context, context string, contextUuid string) (map[string]bool, error) {
+	query := fmt.Sprintf(
+		`SELECT DISTINCT pluto_image_uuid::text FROM %s.pluto_image_link
+		 WHERE context = $1 AND ($2 = '' OR context_uuid::text = $2)`,
+		pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query, context, contextUuid)
+	if err != nil {
+		return nil, fmt.Errorf("Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	uuids := map[string]bool{}
+	for rows.Next() {
+		var imageUuid string
+		if err := rows.Scan(&imageUuid); err != nil {
+			return nil, err
+		}
+		uuids[imageUuid] = true
+	}
+
+	return uuids, rows.Err()
+}
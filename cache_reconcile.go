@@ -0,0 +1,151 @@
+package pluto
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CacheReconcileOptions configures ReconcileCache
+type CacheReconcileOptions struct {
+	DryRun bool // only report, change nothing
+}
+
+// CacheReconcileResult reports how cache files and pluto_cache rows were brought in line
+type CacheReconcileResult struct {
+	DryRun       bool     `json:"dry_run"`
+	Files        int      `json:"files"`
+	Rows         int      `json:"rows"`
+	OrphanFiles  []string `json:"orphan_files"` // files of images which no longer exist, deleted
+	StaleRows    int      `json:"stale_rows"`   // rows without file, deleted
+	Backfilled   int      `json:"backfilled"`   // files without row, row inserted
+	Unrecognized []string `json:"unrecognized"` // file names which are no receipt, left alone
+}
+
+// ParseCacheFileName splits a cache file name (uuid_paramCode_paramValues.type) into
+// the image uuid, the receipt and the image type.
+func ParseCacheFileName(name string) (imageUuid string, receipt string, fileType string, ok bool) {
+	ext := path.Ext(name)
+	fileType = strings.TrimPrefix(ext, ".")
+	receipt = strings.TrimSuffix(name, ext)
+
+	imageUuid, _, found := strings.Cut(receipt, "_")
+	if !found || !isImageType(fileType) || validateUuid(imageUuid) != nil {
+		return "", "", "", false
+	}
+
+	return imageUuid, receipt, fileType, true
+}
+
+// ReconcileCache deletes cache files of images which no longer exist and pluto_cache
+// rows whose file is missing, and inserts rows for files not tracked yet.
+func (pluto *Pluto) ReconcileCache(ctx context.Context, opts CacheReconcileOptions) (CacheReconcileResult, error) {
+	result := CacheReconcileResult{DryRun: opts.DryRun, OrphanFiles: []string{}, Unrecognized: []string{}}
+
+	images, err := pluto.imageUuids(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	// Rows keyed by file name, the receipt with the type as extension
+	query := fmt.Sprintf(`SELECT id, receipt, mime_type FROM %s.pluto_cache`, pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query)
+	if err != nil {
+		return result, fmt.Errorf("Query failed: %w", err)
+	}
+	rowIds := map[string][]int{}
+	for rows.Next() {
+		var id int
+		var receipt, fileType string
+		if err := rows.Scan(&id, &receipt, &fileType); err != nil {
+			rows.Close()
+			return result, err
+		}
+		rowIds[receipt+"."+fileType] = append(rowIds[receipt+"."+fileType], id)
+		result.Rows++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	objects, err := pluto.CacheStorage.List(ctx, "")
+	if err != nil {
+		return result, fmt.Errorf("List failed: %w", err)
+	}
+
+	files := map[string]bool{}
+	for _, object := range objects {
+		result.Files++
+
+		imageUuid, receipt, fileType, ok := ParseCacheFileName(object.Key)
+		if !ok {
+			result.Unrecognized = append(result.Unrecognized, object.Key)
+			continue
+		}
+
+		if !images[strings.ToLower(imageUuid)] {
+			result.OrphanFiles = append(result.OrphanFiles, object.Key)
+			if !opts.DryRun {
+				if err := pluto.CacheStorage.Delete(ctx, object.Key); err != nil {
+					return result, fmt.Errorf("Failed to delete %s: %w", object.Key, err)
+				}
+			}
+			continue
+		}
+		files[object.Key] = true
+
+		// A render may insert the row meanwhile
+		if _, tracked := rowIds[object.Key]; !tracked {
+			result.Backfilled++
+			if !opts.DryRun {
+				query := fmt.Sprintf(
+					`INSERT INTO %s.pluto_cache (receipt, pluto_image_uuid, mime_type) VALUES ($1, $2::uuid, $3)
+					 ON CONFLICT (receipt, mime_type) DO NOTHING`,
+					pluto.DbSchema)
+				if _, err := pluto.DbPool.Exec(ctx, query, receipt, imageUuid, fileType); err != nil {
+					return result, fmt.Errorf("Failed to insert pluto_cache row of %s: %w", object.Key, err)
+				}
+			}
+		}
+	}
+
+	// Rows without file, including the ones of orphans deleted above
+	var staleIds []int
+	for fileName, ids := range rowIds {
+		if !files[fileName] {
+			staleIds = append(staleIds, ids...)
+		}
+	}
+	result.StaleRows = len(staleIds)
+	if len(staleIds) > 0 && !opts.DryRun {
+		query := fmt.Sprintf(`DELETE FROM %s.pluto_cache WHERE id = ANY($1)`, pluto.DbSchema)
+		if _, err := pluto.DbPool.Exec(ctx, query, staleIds); err != nil {
+			return result, fmt.Errorf("Failed to delete stale pluto_cache rows: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// imageUuids returns the uuids of all images
+func (pluto *Pluto) imageUuids(ctx context.Context) (map[string]bool, error) {
+	query := fmt.Sprintf(`SELECT uuid::text FROM %s.pluto_image`, pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	uuids := map[string]bool{}
+	for rows.Next() {
+		var imageUuid string
+		if err := rows.Scan(&imageUuid); err != nil {
+			return nil, err
+		}
+		uuids[imageUuid] = true
+	}
+
+	return uuids, rows.Err()
+}
@@ -0,0 +1,39 @@
+package pluto
+
+import "testing"
+
+func TestParseCacheFileName(t *testing.T) {
+	const u = "0190b5a2-7c4e-7a3b-9d2f-1e2d3c4b5a69"
+	tests := []struct {
+		name     string
+		uuid     string
+		receipt  string
+		fileType string
+		ok       bool
+	}{
+		{u + "_qw_500140.webp", u, u + "_qw_500140", "webp", true},
+		{u + "_qwr_500140_3fe38e39.jpg", u, u + "_qwr_500140_3fe38e39", "jpg", true},
+		{u + "__.avif", u, u + "__", "avif", true},
+		{u + "_qw_500140.gif", "", "", "", false},
+		{u + ".jpg", "", "", "", false},
+		{"not-a-uuid_qw_500140.jpg", "", "", "", false},
+		{".tmp-" + u + "_qw_500140.jpg-123", "", "", "", false},
+	}
+	for _, tt := range tests {
+		imageUuid, receipt, fileType, ok := ParseCacheFileName(tt.name)
+		if imageUuid != tt.uuid || receipt != tt.receipt || fileType != tt.fileType || ok != tt.ok {
+			t.Errorf("ParseCacheFileName(%q) = %q, %q, %q, %t", tt.name, imageUuid, receipt, fileType, ok)
+		}
+	}
+}
+
+func TestCacheFileNameRoundTrip(t *testing.T) {
+	const u = "0190b5a2-7c4e-7a3b-9d2f-1e2d3c4b5a69"
+	opts := newTestPluto().DefaultImageOptions()
+	opts.Width, opts.Height, opts.Ratio, opts.HasRatio = 640, 360, 1.78, true
+
+	imageUuid, receipt, fileType, ok := ParseCacheFileName(opts.CacheFileName(u))
+	if !ok || imageUuid != u || receipt != opts.Receipt(u) || fileType != opts.Type {
+		t.Errorf("ParseCacheFileName(%q) = %q, %q, %q, %t", opts.CacheFileName(u), imageUuid, receipt, fileType, ok)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/sndcds/pluto"
+)
+
+func cleanupCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := newFlagSet("cleanup", &common)
+	dryRun := fs.Bool("dry-run", false, "only list orphaned files")
+	maxDeletes := fs.Int("max-deletes", -1, "abort if more files would be deleted, 0 = no limit (default from config)")
+	minAge := fs.Duration("min-age", -1, "skip files modified more recently (default from config)")
+	stopOnError := fs.Bool("stop-on-error", false, "abort at the first failed delete instead of trying the remaining files")
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	opts := p.DefaultCleanupOptions()
+	opts.DryRun = *dryRun
+	opts.StopOnError = *stopOnError
+	if *maxDeletes >= 0 {
+		opts.MaxDeletes = *maxDeletes
+	}
+	if *minAge >= 0 {
+		opts.MinAge = *minAge
+	}
+
+	result, err := p.CleanupOrphanImages(ctx, opts)
+	printJson(result)
+	return err
+}
+
+func purgeCacheCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	var filter pluto.CachePurgeFilter
+	fs := newFlagSet("purge-cache", &common)
+	fs.StringVar(&filter.ImageUuid, "image", "", "only files of this image uuid")
+	fs.StringVar(&filter.Context, "context", "", "only files of images linked in this context")
+	fs.StringVar(&filter.ContextUuid, "context-uuid", "", "only files of images linked to this context uuid, requires -context")
+	fs.DurationVar(&filter.OlderThan, "older-than", 0, "only files rendered longer ago than this duration, e.g. 720h")
+	fs.BoolVar(&filter.DryRun, "dry-run", false, "only count the files")
+	_ = fs.Parse(args)
+
+	if filter.ContextUuid != "" && filter.Context == "" {
+		return fmt.Errorf("-context-uuid requires -context")
+	}
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	result, err := p.PurgeCache(ctx, filter)
+	printJson(result)
+	return err
+}
+
+func reconcileCacheCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	var opts pluto.CacheReconcileOptions
+	fs := newFlagSet("reconcile-cache", &common)
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only report, change nothing")
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	result, err := p.ReconcileCache(ctx, opts)
+	printJson(result)
+	return err
+}
+
+func regenerateCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	var opts pluto.RegenerateOptions
+	fs := newFlagSet("regenerate", &common)
+	fs.StringVar(&opts.ImageUuid, "image", "", "only this image uuid")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "only count the images")
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	result, err := p.RegenerateMasters(ctx, opts)
+	printJson(result)
+	if err == nil && len(result.Failed) > 0 {
+		err = fmt.Errorf("%d images failed", len(result.Failed))
+	}
+	return err
+}
+
+func pruneVersionsCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := newFlagSet("prune-versions", &common)
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	pruned, err := p.PruneImageVersions(ctx)
+	printJson(map[string]int{"pruned": pruned})
+	return err
+}
+
+func statsCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := newFlagSet("stats", &common)
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	stats, err := p.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	printJson(stats)
+	return nil
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := newFlagSet("verify", &common)
+	_ = fs.Parse(args)
+
+	p, err := open(ctx, common, pluto.WithSchemaCheck())
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	result, err := p.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	printJson(result)
+	if len(result.Missing) > 0 {
+		return fmt.Errorf("%d files missing", len(result.Missing))
+	}
+	return nil
+}
+
+func printJson(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,180 @@
+// Command pluto runs the pluto image service as a standalone HTTP server and
+// provides admin subcommands.
+//
+//	pluto [serve] -config pluto.json [-migrate] [-verbose]
+//	pluto cleanup -config pluto.json [-dry-run]
+//	pluto purge-cache -config pluto.json [-image uuid] [-context name [-context-uuid uuid]] [-older-than 720h] [-dry-run]
+//	pluto reconcile-cache -config pluto.json [-dry-run]
+//	pluto regenerate -config pluto.json [-image uuid] [-dry-run]
+//	pluto prune-versions -config pluto.json
+//	pluto stats -config pluto.json
+//	pluto verify -config pluto.json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sndcds/pluto"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the HTTP server (default)", serveCommand},
+	{"cleanup", "delete image files not referenced by pluto_image", cleanupCommand},
+	{"purge-cache", "delete rendered cache files by image, context or age", purgeCacheCommand},
+	{"reconcile-cache", "delete orphaned cache files and stale pluto_cache rows, track untracked files", reconcileCacheCommand},
+	{"regenerate", "derive the normalized masters again from the originals", regenerateCommand},
+	{"prune-versions", "delete image versions beyond the configured retention", pruneVersionsCommand},
+	{"stats", "print image, cache and storage statistics", statsCommand},
+	{"verify", "report images whose files are missing in the storage", verifyCommand},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Without a subcommand pluto serves, flags may follow directly
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\ncommands:\n", name)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+	os.Exit(2)
+}
+
+// commonFlags are accepted by all commands
+type commonFlags struct {
+	configPath string
+	verbose    bool
+}
+
+func newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&common.configPath, "config", "pluto.json", "path to the JSON config file")
+	fs.BoolVar(&common.verbose, "verbose", false, "verbose logging")
+	return fs
+}
+
+// open loads the config, connects to the database and creates the Pluto instance
+func open(ctx context.Context, common commonFlags, opts ...pluto.Option) (*pluto.Pluto, error) {
+	config, err := pluto.LoadConfig(common.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config: %w", err)
+	}
+
+	pool, err := pgxpool.New(ctx, config.DatabaseUrl())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create database pool: %w", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("Failed to connect to database: %w", err)
+	}
+
+	p, err := pluto.New(config, pool, common.verbose || config.PlutoVerbose, opts...)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	var common commonFlags
+	fs := newFlagSet("serve", &common)
+	migrate := fs.Bool("migrate", false, "apply pending database migrations on startup")
+	_ = fs.Parse(args)
+
+	opts := []pluto.Option{pluto.WithSchemaCheck()}
+	if *migrate {
+		opts = []pluto.Option{pluto.WithAutoMigrate(), pluto.WithSchemaCheck()}
+	}
+
+	p, err := open(ctx, common, opts...)
+	if err != nil {
+		return err
+	}
+	defer p.DbPool.Close()
+
+	if !p.Verbose {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	router := gin.New()
+	router.Use(gin.Logger(), gin.Recovery())
+
+	router.GET("/healthz", func(gc *gin.Context) {
+		if err := p.DbPool.Ping(gc.Request.Context()); err != nil {
+			gc.String(http.StatusServiceUnavailable, "database unavailable")
+			return
+		}
+		gc.String(http.StatusOK, "ok")
+	})
+
+	p.RegisterRoutes(&router.RouterGroup)
+
+	server := &http.Server{
+		Addr:              p.Config.ServerAddress,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("pluto listening on %s", p.Config.ServerAddress)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Let running requests, e.g. renders and uploads, finish
+	log.Print("pluto shutting down")
+	timeout := time.Duration(p.Config.ServerShutdownTimeout) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("Shutdown failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package pluto
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Package level API kept for compatibility, the functions below use PlutoInstance,
+// the instance created by the most recent Initialize. Services running several
+// instances call the methods of *Pluto instead.
+
+func UpsertImage(
+	gc *gin.Context,
+	context string,
+	contextUuid string,
+	identifier string,
+	fileNamePrefix *string,
+	userUuid string,
+	postCallback TxFunc,
+) (UpsertImageResult, error) {
+	return PlutoInstance.UpsertImage(gc, context, contextUuid, identifier, fileNamePrefix, userUuid, postCallback)
+}
+
+func DeleteImage(
+	gc *gin.Context,
+	context string,
+	contextUuid string,
+	identifier string,
+	postCallback TxFunc,
+) (DeleteImageResult, error) {
+	return PlutoInstance.DeleteImage(gc, context, contextUuid, identifier, postCallback)
+}
+
+func LinkImage(
+	gc *gin.Context,
+	imageUuid string,
+	context string,
+	contextUuid string,
+	identifier string,
+	postCallback TxFunc,
+) (LinkImageResult, error) {
+	return PlutoInstance.LinkImage(gc, imageUuid, context, contextUuid, identifier, postCallback)
+}
+
+func GetImageUuidByByContext(
+	gc *gin.Context,
+	context string,
+	contextUuid string,
+	identifier string,
+) (string, bool) {
+	return PlutoInstance.GetImageUuidByByContext(gc, context, contextUuid, identifier)
+}
+
+func CleanupImages(ctx context.Context) error {
+	return PlutoInstance.CleanupImages(ctx)
+}
+
+func BuildSrcsetManifest(
+	ctx context.Context,
+	imageUuid string,
+	opts ImageOptions,
+	widths []int,
+	types []string,
+) (*SrcsetManifest, error) {
+	return PlutoInstance.BuildSrcsetManifest(ctx, imageUuid, opts, widths, types)
+}
+
+func DefaultImageOptions() ImageOptions {
+	return PlutoInstance.DefaultImageOptions()
+}
+
+func ParseImageOptions(query url.Values) (ImageOptions, error) {
+	return PlutoInstance.ParseImageOptions(query)
+}
+
+func PresetQuery(name string) (url.Values, error) {
+	return PlutoInstance.PresetQuery(name)
+}
+
+func PresetURL(imageUuid string, name string) string {
+	return PlutoInstance.PresetURL(imageUuid, name)
+}
+
+func ImageSignature(imageUuid string, opts ImageOptions) string {
+	return PlutoInstance.ImageSignature(imageUuid, opts)
+}
+
+func SignedURL(imageUuid string, opts ImageOptions) (string, error) {
+	return PlutoInstance.SignedURL(imageUuid, opts)
+}
+
+func CleanupPlutoImageFiles(imageUuid string, fileNames ...string) (*ImageCleanupResult, error) {
+	return PlutoInstance.CleanupPlutoImageFiles(imageUuid, fileNames...)
+}
+
+func CleanupPlutoImage(imageFileName string) (bool, error) {
+	return PlutoInstance.CleanupPlutoImage(imageFileName)
+}
+
+func CleanupPlutoCache(imageUuid string) (int, error) {
+	return PlutoInstance.CleanupPlutoCache(imageUuid)
+}
+
+func GetImageFocusTx(ctx context.Context, tx pgx.Tx, imageUuid string) (focusX *float64, focusY *float64, err error) {
+	return PlutoInstance.GetImageFocusTx(ctx, tx, imageUuid)
+}
+
+func DeleteImageTx(ctx context.Context, tx pgx.Tx, imageUuid string) (deletedFileName string, cacheRows int64, err error) {
+	return PlutoInstance.DeleteImageTx(ctx, tx, imageUuid)
+}
+
+func DeleteCacheTx(ctx context.Context, tx pgx.Tx, imageUuid string) (deletedFilesCount int64, err error) {
+	return PlutoInstance.DeleteCacheTx(ctx, tx, imageUuid)
+}
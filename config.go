@@ -3,52 +3,149 @@ package pluto
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 )
 
 // Config holds database configuration details
 type Config struct {
-	BaseApiUrl            string `json:"base_api_url"`
-	DbHost                string `json:"db_host"`
-	DbPort                int    `json:"db_port"`
-	DbUser                string `json:"db_user"`
-	DbPassword            string `json:"db_password"`
-	DbName                string `json:"db_name"`
-	DbSchema              string `json:"db_schema"`
-	SSLMode               string `json:"ssl_mode"`
-	PlutoVerbose          bool   `json:"pluto_verbose"`
-	PlutoRoute            string `json:"pluto_route"`
-	PlutoImageDir         string `json:"pluto_image_dir"`
-	PlutoCacheDir         string `json:"pluto_cache_dir"`
-	PlutoMaxImageSize     int64  `json:"pluto_max_image_size"`
-	PlutoMaxImagePx       int    `json:"pluto_max_image_px"`
-	PlutoDefaultQuality   int    `json:"pluto_default_quality"`
-	PlutoDefaultImageType string `json:"pluto_default_image_type"`
+	BaseApiUrl              string            `json:"base_api_url"`
+	DbHost                  string            `json:"db_host"`
+	DbPort                  int               `json:"db_port"`
+	DbUser                  string            `json:"db_user"`
+	DbPassword              string            `json:"db_password"`
+	DbName                  string            `json:"db_name"`
+	DbSchema                string            `json:"db_schema"`
+	SSLMode                 string            `json:"ssl_mode"`
+	PlutoVerbose            bool              `json:"pluto_verbose"`
+	PlutoRoute              string            `json:"pluto_route"`
+	PlutoImageDir           string            `json:"pluto_image_dir"`
+	PlutoCacheDir           string            `json:"pluto_cache_dir"`
+	PlutoMaxImageSize       int64             `json:"pluto_max_image_size"`
+	PlutoMaxImagePx         int               `json:"pluto_max_image_px"`
+	PlutoDefaultQuality     int               `json:"pluto_default_quality"`
+	PlutoDefaultImageType   string            `json:"pluto_default_image_type"`
+	PlutoAvifSpeed          int               `json:"pluto_avif_speed"`
+	PlutoSignatureSecret    string            `json:"pluto_signature_secret"`
+	PlutoPresets            map[string]string `json:"pluto_presets"`
+	PlutoPresetsOnly        bool              `json:"pluto_presets_only"`
+	PlutoDimensionMode      string            `json:"pluto_dimension_mode"`
+	PlutoDimensionStep      int               `json:"pluto_dimension_step"`
+	PlutoAllowedWidths      []int             `json:"pluto_allowed_widths"`
+	PlutoAllowedHeights     []int             `json:"pluto_allowed_heights"`
+	PlutoAllowedRatios      []string          `json:"pluto_allowed_ratios"`
+	PlutoSrcsetWidths       []int             `json:"pluto_srcset_widths"`
+	PlutoSrcsetTypes        []string          `json:"pluto_srcset_types"`
+	PlutoRenderConcurrency  int               `json:"pluto_render_concurrency"`
+	PlutoRenderQueueSize    int               `json:"pluto_render_queue_size"`
+	PlutoRenderQueueTimeout int               `json:"pluto_render_queue_timeout"`
+	PlutoStorage            string            `json:"pluto_storage"`
+	PlutoS3Endpoint         string            `json:"pluto_s3_endpoint"`
+	PlutoS3Region           string            `json:"pluto_s3_region"`
+	PlutoS3Bucket           string            `json:"pluto_s3_bucket"`
+	PlutoS3AccessKey        string            `json:"pluto_s3_access_key"`
+	PlutoS3SecretKey        string            `json:"pluto_s3_secret_key"`
+	PlutoS3UseSSL           bool              `json:"pluto_s3_use_ssl"`
+	PlutoS3ImagePrefix      string            `json:"pluto_s3_image_prefix"`
+	PlutoS3CachePrefix      string            `json:"pluto_s3_cache_prefix"`
+	PlutoEnableWriteRoutes  bool              `json:"pluto_enable_write_routes"`
+	PlutoCleanupMaxDeletes  int               `json:"pluto_cleanup_max_deletes"`
+	PlutoCleanupMinAge      int               `json:"pluto_cleanup_min_age"`
+	PlutoVersionsKeep       int               `json:"pluto_versions_keep"`
+	PlutoVersionsMaxAge     int               `json:"pluto_versions_max_age"`
+	ServerAddress           string            `json:"server_address"`
+	ServerShutdownTimeout   int               `json:"server_shutdown_timeout"`
 }
 
 func DefaultConfig() Config {
 	return Config{
-		BaseApiUrl:            "",
-		DbHost:                "",
-		DbPort:                5432,
-		DbUser:                "postgres",
-		DbPassword:            "",
-		DbName:                "",
-		DbSchema:              "",
-		SSLMode:               "disable",
-		PlutoVerbose:          false,
-		PlutoRoute:            "/image",
-		PlutoImageDir:         "",
-		PlutoCacheDir:         "",
-		PlutoMaxImageSize:     int64(10 << 20), // 10 Mb
-		PlutoMaxImagePx:       4096,
-		PlutoDefaultQuality:   85,
-		PlutoDefaultImageType: "webp",
+		BaseApiUrl:              "",
+		DbHost:                  "",
+		DbPort:                  5432,
+		DbUser:                  "postgres",
+		DbPassword:              "",
+		DbName:                  "",
+		DbSchema:                "",
+		SSLMode:                 "disable",
+		PlutoVerbose:            false,
+		PlutoRoute:              "/image",
+		PlutoImageDir:           "",
+		PlutoCacheDir:           "",
+		PlutoMaxImageSize:       int64(10 << 20), // 10 Mb
+		PlutoMaxImagePx:         4096,
+		PlutoDefaultQuality:     85,
+		PlutoDefaultImageType:   "jpg",               // jpg, png, webp, avif or auto
+		PlutoAvifSpeed:          8,                   // 1 (slow, small) - 10 (fast)
+		PlutoSignatureSecret:    "",                  // signed image URLs are required if set
+		PlutoPresets:            map[string]string{}, // e.g. "hero": "width=1280&ratio=16:9&type=webp"
+		PlutoPresetsOnly:        false,
+		PlutoDimensionMode:      DimensionModeSnap, // snap or reject
+		PlutoDimensionStep:      0,                 // e.g. 80 to allow multiples of 80 px only
+		PlutoAllowedWidths:      nil,
+		PlutoAllowedHeights:     nil,
+		PlutoAllowedRatios:      nil, // e.g. ["1:1", "4:3", "16:9"], other ratios are rounded to 0.01
+		PlutoSrcsetWidths:       []int{320, 640, 960, 1280, 1920, 2560},
+		PlutoSrcsetTypes:        []string{"avif", "webp", "jpg"}, // last one is the <img> fallback
+		PlutoRenderConcurrency:  0,                               // 0 = number of CPUs
+		PlutoRenderQueueSize:    64,                              // renders waiting for a slot, more get 503
+		PlutoRenderQueueTimeout: 10,                              // seconds
+		PlutoStorage:            StorageFilesystem,               // fs or s3
+		PlutoS3Endpoint:         "",                              // e.g. localhost:9000 for MinIO
+		PlutoS3Region:           "",
+		PlutoS3Bucket:           "",
+		PlutoS3AccessKey:        "",
+		PlutoS3SecretKey:        "",
+		PlutoS3UseSSL:           true,
+		PlutoS3ImagePrefix:      "images/",
+		PlutoS3CachePrefix:      "cache/",
+		PlutoEnableWriteRoutes:  false,   // POST/PUT/DELETE /:context/:contextUuid/:identifier
+		PlutoCleanupMaxDeletes:  100,     // cleanup aborts if more files would be deleted, 0 = no limit
+		PlutoCleanupMinAge:      3600,    // seconds, younger files may belong to running uploads
+		PlutoVersionsKeep:       5,       // replaced masters kept per image, 0 = no history
+		PlutoVersionsMaxAge:     0,       // days a replaced master is kept, 0 = no limit
+		ServerAddress:           ":8080", // cmd/pluto only
+		ServerShutdownTimeout:   15,      // seconds
 	}
 }
 
+// LoadConfig reads a JSON config file, fields missing in the file keep their default
+func LoadConfig(configFilePath string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// DatabaseUrl returns the connection string for pgxpool built from the Db* fields
+func (config Config) DatabaseUrl() string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(config.DbUser, config.DbPassword),
+		Host:   net.JoinHostPort(config.DbHost, strconv.Itoa(config.DbPort)),
+		Path:   "/" + config.DbName,
+	}
+	if config.SSLMode != "" {
+		u.RawQuery = url.Values{"sslmode": {config.SSLMode}}.Encode()
+	}
+	return u.String()
+}
+
 func (config Config) Print() {
 	fmt.Println("Pluto Config")
 
+	// config is a copy, secrets stay out of the log
+	config.redact()
+
 	b, err := json.MarshalIndent(config, "  ", "  ")
 	if err != nil {
 		fmt.Println("  Error printing config:", err)
@@ -57,3 +154,18 @@ func (config Config) Print() {
 
 	fmt.Println(string(b))
 }
+
+// redact masks the secrets of the config, empty ones stay empty
+func (config *Config) redact() {
+	secrets := []*string{
+		&config.DbPassword,
+		&config.PlutoSignatureSecret,
+		&config.PlutoS3AccessKey,
+		&config.PlutoS3SecretKey,
+	}
+	for _, secret := range secrets {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
 )
 
 // DeleteImageResult mirrors UpsertImageResult
@@ -18,8 +19,34 @@ type DeleteImageResult struct {
 	ImageUuid         string
 }
 
+// API: DELETE /image/:context/:contextUuid/:identifier
+func (pluto *Pluto) deleteImageByContext(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "delete-pluto-image")
+
+	context, contextUuid, identifier := gc.Param("context"), gc.Param("contextUuid"), gc.Param("identifier")
+	if _, ok := pluto.authorizeWrite(gc, apiRequest, ActionDelete, context, contextUuid, identifier); !ok {
+		return
+	}
+
+	result, err := pluto.DeleteImage(gc, context, contextUuid, identifier, nil)
+	if err != nil {
+		apiRequest.InternalServerError()
+		return
+	}
+	if result.HttpStatus != http.StatusOK {
+		apiRequest.Error(result.HttpStatus, result.Message)
+		return
+	}
+
+	apiRequest.Success(http.StatusOK, ImageWriteResponse{
+		ImageUuid:         result.ImageUuid,
+		FileRemoved:       result.FileRemovedFlag,
+		CacheFilesRemoved: result.CacheFilesRemoved,
+	}, result.Message)
+}
+
 // DeleteImage deletes an image by context/contextId/identifier
-func DeleteImage(
+func (pluto *Pluto) DeleteImage(
 	gc *gin.Context,
 	context string,
 	contextUuid string,
@@ -27,24 +54,23 @@ func DeleteImage(
 	postCallback TxFunc,
 ) (DeleteImageResult, error) {
 	ctx := gc.Request.Context()
-	dbSchema := PlutoInstance.DbSchema
+	dbSchema := pluto.DbSchema
 
 	var result DeleteImageResult
-	genFileName := ""
 	imageUuid := ""
+	var fileNames []string
 
-	txErr := WithTransaction(ctx, PlutoInstance.DbPool, func(tx pgx.Tx) *ApiTxError {
-		// Get the linked imageUuid and generated file name
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
+		// Get the linked imageUuid
 		query := fmt.Sprintf(
-			`SELECT i.uuid, i.gen_file_name
-			 FROM %s.pluto_image_link l
-			 JOIN %s.pluto_image i ON i.uuid = l.pluto_image_uuid
-			 WHERE l.context = $1 AND l.context_uuid = $2::uuid AND l.identifier = $3`,
-			dbSchema, dbSchema,
+			`SELECT pluto_image_uuid
+			 FROM %s.pluto_image_link
+			 WHERE context = $1 AND context_uuid = $2::uuid AND identifier = $3`,
+			dbSchema,
 		)
-		err := tx.QueryRow(ctx, query, context, contextUuid, identifier).Scan(&imageUuid, &genFileName)
+		err := tx.QueryRow(ctx, query, context, contextUuid, identifier).Scan(&imageUuid)
 		if err != nil {
-			fmt.Print("Error 1: %v\n", err)
+			fmt.Printf("Error 1: %v\n", err)
 			if errors.Is(err, pgx.ErrNoRows) {
 				// Image does not exist, nothing to delete
 				result.HttpStatus = http.StatusNotFound
@@ -65,53 +91,27 @@ func DeleteImage(
 		)
 		_, err = tx.Exec(ctx, query, context, contextUuid, identifier)
 		if err != nil {
-			fmt.Print("Error 2: %v\n", err)
+			fmt.Printf("Error 2: %v\n", err)
 			return &ApiTxError{
 				Code: http.StatusInternalServerError,
 				Err:  fmt.Errorf("Failed to delete pluto_image_link: %v", err),
 			}
 		}
 
-		// Optionally delete the image row itself if no other links exist
-		var linkCount int
-		query = fmt.Sprintf(
-			`SELECT COUNT(*) FROM %s.pluto_image_link WHERE pluto_image_uuid = $1::uuid`,
-			dbSchema,
-		)
-		err = tx.QueryRow(ctx, query, imageUuid).Scan(&linkCount)
-		if err != nil {
-			fmt.Print("Error 3: %v\n", err)
-			return &ApiTxError{
-				Code: http.StatusInternalServerError,
-				Err:  fmt.Errorf("Failed to count image links: %v", err),
-			}
-		}
-
-		if linkCount == 0 {
-			query = fmt.Sprintf(`DELETE FROM %s.pluto_image WHERE uuid = $1::uuid`, dbSchema)
-			_, err := tx.Exec(ctx, query, imageUuid)
-			if err != nil {
-				fmt.Print("Error 4: %v\n", err)
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  fmt.Errorf("Failed to delete pluto_image: %v", err),
-				}
-			}
-		}
-
-		_, err = DeleteCacheTx(ctx, tx, imageUuid)
+		// The image and its files go with the last link
+		fileNames, err = pluto.releaseImageTx(ctx, tx, imageUuid)
 		if err != nil {
-			fmt.Print("Error 5: %v\n", err)
+			fmt.Printf("Error 3: %v\n", err)
 			return &ApiTxError{
 				Code: http.StatusInternalServerError,
-				Err:  fmt.Errorf("Failed to delete cached files: %v", err),
+				Err:  fmt.Errorf("Failed to release pluto_image: %v", err),
 			}
 		}
 
 		// Call optional post-transaction callback
 		if postCallback != nil {
 			if err := postCallback(ctx, tx); err != nil {
-				fmt.Print("Error 6: %v\n", err)
+				fmt.Printf("Error 4: %v\n", err)
 				return &ApiTxError{
 					Code: http.StatusInternalServerError,
 					Err:  fmt.Errorf("Post callback function failed: %v", err),
@@ -127,16 +127,27 @@ func DeleteImage(
 		return result, txErr.Err
 	}
 
+	if result.HttpStatus == http.StatusNotFound {
+		return result, nil
+	}
+
+	result.HttpStatus = http.StatusOK
+	result.ImageUuid = imageUuid
+
+	// Other links still show the image
+	if len(fileNames) == 0 {
+		result.Message = "image unlinked, still used by other links"
+		return result, nil
+	}
+
 	// Filesystem cleanup (post-commit)
-	cleanup, err := CleanupPlutoImageFiles(imageUuid, genFileName)
+	cleanup, err := pluto.CleanupPlutoImageFiles(imageUuid, fileNames...)
 	if err == nil {
 		result.CacheFilesRemoved = cleanup.CacheFilesRemoved
 		result.FileRemovedFlag = cleanup.ImageFileRemoved
 	}
 
-	result.HttpStatus = http.StatusOK
 	result.Message = "image deleted successfully"
-	result.ImageUuid = imageUuid
 
 	return result, nil
 }
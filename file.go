@@ -1,24 +1,21 @@
 package pluto
 
 import (
+	"context"
 	"fmt"
+	"mime"
 	"net/http"
 	"os"
-	"time"
+	"path/filepath"
 
 	"github.com/gin-gonic/gin"
 )
 
 // serveCacheFile serves the cached file and updates its access time.
-func serveCacheFile(gc *gin.Context, cacheFilePath, cacheFileName string) {
-	info, err := os.Stat(cacheFilePath)
-	if err != nil {
-		// File does not exist, handle accordingly (404 or generate)
-		gc.Status(http.StatusNotFound)
-		return
-	}
+func (pluto *Pluto) serveCacheFile(gc *gin.Context, info StorageObject) {
+	storage := pluto.CacheStorage
 
-	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size())
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime.Unix(), info.Size)
 
 	// Handle conditional GET
 	if match := gc.GetHeader("If-None-Match"); match == etag {
@@ -27,21 +24,79 @@ func serveCacheFile(gc *gin.Context, cacheFilePath, cacheFileName string) {
 	}
 
 	gc.Header("ETag", etag)
-	gc.Header("Cache-Control", "no-cache")
-	gc.Header("Content-Disposition", `inline; filename="`+cacheFileName+`"`)
+	gc.Header("Cache-Control", pluto.cacheControl())
+	gc.Header("Content-Disposition", `inline; filename="`+info.Key+`"`)
 
 	// Safely touch the file
-	touchFile(cacheFilePath, info.ModTime())
+	touchFile(gc.Request.Context(), storage, info)
 
 	// Serve the file
-	gc.File(cacheFilePath)
+	serveStorageFile(gc, storage, info.Key)
+}
+
+// serveStorageFile serves a file from a storage, local files are served directly.
+func serveStorageFile(gc *gin.Context, storage Storage, key string) {
+	if local, ok := storage.(storageLocalPather); ok {
+		gc.File(local.LocalPath(key))
+		return
+	}
+
+	data, err := storage.Get(gc.Request.Context(), key)
+	if err != nil {
+		gc.Status(http.StatusNotFound)
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	gc.Data(http.StatusOK, contentType, data)
 }
 
-// touchFile updates the access time of the given file safely.
+// cacheControl keeps shared caches from storing images when access is restricted
+func (pluto *Pluto) cacheControl() string {
+	if pluto.Authorizer != nil {
+		return "private, no-cache"
+	}
+	return "no-cache"
+}
+
+// touchFile updates the access time of the given file safely, if the storage supports it.
 // Logs a warning if it fails, but does not stop execution.
-func touchFile(path string, mtime time.Time) {
-	now := time.Now()
-	if err := os.Chtimes(path, now, mtime); err != nil {
-		fmt.Printf("Warning: failed to touch file %s: %v\n", path, err)
+func touchFile(ctx context.Context, storage Storage, info StorageObject) {
+	toucher, ok := storage.(storageToucher)
+	if !ok {
+		return
+	}
+	if err := toucher.Touch(ctx, info.Key, info.ModTime); err != nil {
+		fmt.Printf("Warning: failed to touch file %s: %v\n", info.Key, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames
+// it to path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
 	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
 }
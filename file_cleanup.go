@@ -2,68 +2,152 @@ package pluto
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"strings"
+	"time"
 )
 
-func CleanupImages(ctx context.Context) error {
-	db := PlutoInstance.DbPool
-	schema := PlutoInstance.DbSchema
-	dir := PlutoInstance.Config.PlutoImageDir
+// ErrCleanupLimit is returned if a cleanup would delete more files than allowed, nothing is deleted then
+var ErrCleanupLimit = errors.New("cleanup would exceed the maximum number of deletions")
 
-	// Load filenames from DB
-	query := fmt.Sprintf("SELECT gen_file_name FROM %s.pluto_image", schema)
+// CleanupOptions configures CleanupOrphanImages
+type CleanupOptions struct {
+	DryRun      bool          // only report orphans, delete nothing
+	MaxDeletes  int           // abort if more files would be deleted, 0 = no limit
+	MinAge      time.Duration // skip files modified more recently, they may belong to running uploads
+	StopOnError bool          // abort at the first failed delete instead of trying the remaining files
+}
+
+// CleanupResult reports the files of the image storage not referenced by pluto_image.
+// Orphans lists the files to delete, Deleted the ones actually deleted.
+type CleanupResult struct {
+	DryRun  bool             `json:"dry_run"`
+	Checked int              `json:"checked"`
+	Orphans []string         `json:"orphans"`
+	Deleted []string         `json:"deleted"`
+	Skipped []CleanupSkip    `json:"skipped"`
+	Failed  []CleanupFailure `json:"failed"`
+}
+
+type CleanupSkip struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+type CleanupFailure struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// DefaultCleanupOptions returns the limits configured by pluto_cleanup_max_deletes and pluto_cleanup_min_age
+func (pluto *Pluto) DefaultCleanupOptions() CleanupOptions {
+	return CleanupOptions{
+		MaxDeletes: pluto.Config.PlutoCleanupMaxDeletes,
+		MinAge:     time.Duration(pluto.Config.PlutoCleanupMinAge) * time.Second,
+	}
+}
+
+// CleanupImages deletes the files of the image storage not referenced by pluto_image
+// with the default options.
+func (pluto *Pluto) CleanupImages(ctx context.Context) error {
+	result, err := pluto.CleanupOrphanImages(ctx, pluto.DefaultCleanupOptions())
+	pluto.Log(fmt.Sprintf("cleanup deleted %d of %d orphaned images", len(result.Deleted), len(result.Orphans)))
+	return err
+}
+
+// CleanupOrphanImages finds the files of the image storage not referenced by
+// pluto_image or pluto_image_version, masters and originals, and deletes them
+// unless opts.DryRun is set.
+func (pluto *Pluto) CleanupOrphanImages(ctx context.Context, opts CleanupOptions) (CleanupResult, error) {
+	db := pluto.DbPool
+	schema := pluto.DbSchema
+	storage := pluto.ImageStorage
+
+	result := CleanupResult{
+		DryRun:  opts.DryRun,
+		Orphans: []string{},
+		Deleted: []string{},
+		Skipped: []CleanupSkip{},
+		Failed:  []CleanupFailure{},
+	}
+
+	// Load filenames from DB, masters and uploaded originals, current and kept versions
+	query := fmt.Sprintf(
+		`SELECT gen_file_name, original_gen_file_name FROM %s.pluto_image
+		 UNION ALL
+		 SELECT gen_file_name, original_gen_file_name FROM %s.pluto_image_version`,
+		schema, schema)
 	rows, err := db.Query(ctx, query)
 	if err != nil {
-		return fmt.Errorf("Query failed: %w", err)
+		return result, fmt.Errorf("Query failed: %w", err)
 	}
 	defer rows.Close()
 
 	validFiles := make(map[string]struct{})
 	for rows.Next() {
-		var name *string // Handle NULL safely
-		if err := rows.Scan(&name); err != nil {
-			return err
+		var name, originalName *string // Handle NULL safely
+		if err := rows.Scan(&name, &originalName); err != nil {
+			return result, err
 		}
-		if name != nil && *name != "" {
-			validFiles[*name] = struct{}{}
+		for _, n := range []*string{name, originalName} {
+			if n != nil && *n != "" {
+				validFiles[*n] = struct{}{}
+			}
 		}
 	}
 
 	if err := rows.Err(); err != nil {
-		return err
+		return result, err
 	}
 
-	// Walk directory
-	deleteCount := 0
-	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
+	// List storage
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return result, fmt.Errorf("List failed: %w", err)
+	}
+
+	minModTime := time.Now().Add(-opts.MinAge)
+	minStagingModTime := time.Now().Add(-max(opts.MinAge, stagingMinAge))
+	for _, object := range objects {
+		result.Checked++
+		if _, exists := validFiles[object.Key]; exists {
+			continue
 		}
-		// Skip directories
-		if d.IsDir() {
-			return nil
+		if strings.HasPrefix(object.Key, stagingPrefix) && object.ModTime.After(minStagingModTime) {
+			result.Skipped = append(result.Skipped, CleanupSkip{File: object.Key, Reason: "staged by a running upload"})
+			continue
 		}
-		fileName := filepath.Base(path)
-
-		// Delete if not in DB
-		if _, exists := validFiles[fileName]; !exists {
-			fmt.Printf("Deleting: %s\n", path)
-			deleteCount++
-			if err := os.Remove(path); err != nil {
-				return fmt.Errorf("Failed to delete %s: %w", path, err)
-			}
+		if opts.MinAge > 0 && object.ModTime.After(minModTime) {
+			result.Skipped = append(result.Skipped, CleanupSkip{File: object.Key, Reason: "modified recently"})
+			continue
 		}
+		result.Orphans = append(result.Orphans, object.Key)
+	}
 
-		return nil
-	})
+	// A wrong schema or directory makes every file look orphaned
+	if opts.MaxDeletes > 0 && len(result.Orphans) > opts.MaxDeletes {
+		return result, fmt.Errorf("%w: %d orphans, limit %d", ErrCleanupLimit, len(result.Orphans), opts.MaxDeletes)
+	}
 
-	if err != nil {
-		return err
+	if opts.DryRun {
+		return result, nil
 	}
 
-	fmt.Printf("Deleted: %d images\n", deleteCount)
+	for _, name := range result.Orphans {
+		if err := storage.Delete(ctx, name); err != nil {
+			result.Failed = append(result.Failed, CleanupFailure{File: name, Error: err.Error()})
+			if opts.StopOnError {
+				return result, fmt.Errorf("Failed to delete %s: %w", name, err)
+			}
+			continue
+		}
+		result.Deleted = append(result.Deleted, name)
+	}
+
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("Failed to delete %d files", len(result.Failed))
+	}
 
-	return nil
+	return result, nil
 }
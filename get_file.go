@@ -3,27 +3,30 @@ package pluto
 import (
 	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sndcds/grains/grains_api"
 )
 
-func getFile(gc *gin.Context) {
+func (pluto *Pluto) getFile(gc *gin.Context) {
 	file := gc.Param("file") // e.g. "abc123.webp"
 
-	// Normalize and join path
-	cacheFilePath := filepath.Join(PlutoInstance.Config.PlutoCacheDir, filepath.Clean(file))
-
 	// Security: Disallow path traversal attempts
-	if strings.Contains(file, "..") || filepath.IsAbs(file) {
+	if strings.Contains(file, "..") || strings.ContainsAny(file, `/\`) || filepath.IsAbs(file) {
 		gc.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid file path"})
 		return
 	}
 
+	// Cache files are named after their receipt, which starts with the image uuid
+	imageUuid, _, _ := strings.Cut(file, "_")
+	if !pluto.authorizeImage(gc, grains_api.NewRequest(gc, "get-pluto-file"), ActionRead, imageUuid) {
+		return
+	}
+
 	// Check if file exists
-	if stat, err := os.Stat(cacheFilePath); err != nil || stat.IsDir() {
+	if _, err := pluto.CacheStorage.Stat(gc.Request.Context(), file); err != nil {
 		gc.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		return
 	}
@@ -39,5 +42,5 @@ func getFile(gc *gin.Context) {
 	// gc.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", file))
 
 	// Serve file
-	gc.File(cacheFilePath)
+	serveStorageFile(gc, pluto.CacheStorage, file)
 }
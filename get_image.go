@@ -2,6 +2,7 @@ package pluto
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -9,15 +10,14 @@ import (
 	"image/jpeg"
 	"image/png"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"github.com/chai2010/webp"
+	"github.com/gen2brain/avif"
 	"github.com/gin-gonic/gin"
 	"github.com/sndcds/grains/grains_api"
 )
 
-func GetImageUuidByByContext(
+func (pluto *Pluto) GetImageUuidByByContext(
 	gc *gin.Context,
 	context string,
 	contextUuid string,
@@ -29,11 +29,11 @@ func GetImageUuidByByContext(
 		`SELECT pluto_image_uuid
          FROM %s.pluto_image_link
          WHERE context = $1 AND context_uuid = $2 AND identifier = $3`,
-		PlutoInstance.DbSchema,
+		pluto.DbSchema,
 	)
 
 	var imageUuid *string
-	err := PlutoInstance.DbPool.
+	err := pluto.DbPool.
 		QueryRow(ctx, query, context, contextUuid, identifier).
 		Scan(&imageUuid)
 
@@ -55,10 +55,31 @@ func GetImageUuidByByContext(
 	return *imageUuid, true
 }
 
-func getImage(gc *gin.Context) {
+// imageRecord holds the columns of pluto_image needed to render an image
+type imageRecord struct {
+	FileName    string
+	GenFileName string
+	MimeType    string
+	FocusX      *float32
+	FocusY      *float32
+}
+
+func (pluto *Pluto) loadImageRecord(ctx context.Context, imageUuid string) (*imageRecord, error) {
+	var record imageRecord
+	query := fmt.Sprintf(`
+		SELECT file_name, gen_file_name, mime_type, focus_x, focus_y FROM %s.pluto_image WHERE uuid = $1`,
+		pluto.DbSchema)
+	err := pluto.DbPool.QueryRow(ctx, query, imageUuid).Scan(
+		&record.FileName, &record.GenFileName, &record.MimeType, &record.FocusX, &record.FocusY)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (pluto *Pluto) getImage(gc *gin.Context) {
 	apiRequest := grains_api.NewRequest(gc, "get-pluto-image")
 	ctx := gc.Request.Context()
-	pool := PlutoInstance.DbPool
 
 	imageUuid := gc.Param("uuid")
 	if imageUuid == "" {
@@ -66,196 +87,250 @@ func getImage(gc *gin.Context) {
 		return
 	}
 
-	fileTypeStr := gc.DefaultQuery("type", "jpg")
-	if fileTypeStr != "jpg" && fileTypeStr != "png" && fileTypeStr != "webp" {
-		apiRequest.Error(http.StatusBadRequest, "invalid type parameter, must be one of 'jpg', 'png' or 'webp'")
-		return
+	presetName := gc.Param("preset")
+	if presetName == "" {
+		presetName = gc.Query("preset")
 	}
 
-	fitStr := gc.DefaultQuery("fit", "")
-	if fitStr != "" && fitStr != "cover" {
-		// TODO: Support more  fit types like in CSS
-		apiRequest.Error(http.StatusBadRequest, "invalid fit parameter")
+	query, err := pluto.resolveImageQuery(presetName, gc.Request.URL.Query())
+	if err != nil {
+		if errors.Is(err, ErrUnknownPreset) {
+			apiRequest.Error(http.StatusNotFound, err.Error())
+			return
+		}
+		apiRequest.Error(http.StatusBadRequest, err.Error())
 		return
 	}
 
-	quality, ok := GetQueryIntDefault(gc, "quality", 80)
-	if !ok {
-		apiRequest.Error(http.StatusBadRequest, "invalid quality parameter")
+	opts, err := pluto.ParseImageOptions(query)
+	if err != nil {
+		apiRequest.Error(http.StatusBadRequest, err.Error())
 		return
 	}
-	if quality < 0 {
-		quality = 0
-	} else if quality > 100 {
-		quality = 100
-	}
 
-	width, ok := GetQueryIntDefault(gc, "width", 0)
-	if !ok {
-		apiRequest.Error(http.StatusBadRequest, "invalid width parameter")
+	// Presets are defined by the deployment, only arbitrary transformations must be signed
+	if presetName == "" && !pluto.verifyImageSignature(imageUuid, opts, gc.Query("sig")) {
+		apiRequest.Error(http.StatusForbidden, "invalid signature")
 		return
 	}
 
-	height, ok := GetQueryIntDefault(gc, "height", 0)
-	if !ok {
-		apiRequest.Error(http.StatusBadRequest, "invalid height parameter")
+	if !pluto.authorizeImage(gc, apiRequest, ActionRead, imageUuid) {
 		return
 	}
 
-	ratioStr, hasRatio := gc.GetQuery("ratio")
-	ratio := float32(0.0)
-	if hasRatio {
-		var err error
-		ratio, err = ParseAspectRatio(ratioStr)
-		if err != nil {
-			apiRequest.Error(http.StatusBadRequest, "invalid ratio parameter")
-			return
+	var record *imageRecord
+	if opts.Type == "auto" {
+		gc.Header("Vary", "Accept")
+		accept := gc.GetHeader("Accept")
+		opaque := true
+		if !acceptsMimeType(accept, "image/avif") && !acceptsMimeType(accept, "image/webp") {
+			// Legacy clients, the fallback type depends on the transparency of the source
+			record, err = pluto.loadImageRecord(ctx, imageUuid)
+			if err != nil {
+				apiRequest.Error(http.StatusNotFound, "Image not found")
+				return
+			}
+			opaque, err = pluto.sourceOpaque(ctx, record)
+			if err != nil {
+				if errors.Is(err, ErrRenderOverloaded) {
+					gc.Header("Retry-After", pluto.renderLimiter.RetryAfter())
+					apiRequest.Error(http.StatusServiceUnavailable, err.Error())
+					return
+				}
+				apiRequest.InternalServerError()
+				return
+			}
 		}
+		opts.Type = NegotiateImageType(accept, opaque)
 	}
 
-	lossless, ok := GetQueryBoolDefault(gc, "lossless", false)
+	cacheFileName := opts.CacheFileName(imageUuid)
 
-	knownEdges := 0
-	if width > 0 {
-		knownEdges++
-	}
-	if height > 0 {
-		knownEdges++
+	// Check if file exist, if so deliver that file
+	if info, err := pluto.CacheStorage.Stat(ctx, cacheFileName); err == nil {
+		pluto.serveCacheFile(gc, info)
+		return
 	}
 
-	if hasRatio && knownEdges == 1 {
-		if ratio <= 0.0001 {
-			apiRequest.Error(http.StatusBadRequest, "invalid ratio format")
+	// Concurrent requests for the same uncached file share one render
+	data, err, _ := pluto.renders.Do(ctx, cacheFileName, func(renderCtx context.Context) ([]byte, error) {
+		return pluto.renderImage(renderCtx, imageUuid, opts, record)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// Client is gone, nothing to answer
+			gc.Abort()
 			return
 		}
-		if width > 0 {
-			height = int(float32(width) / ratio)
-		} else if height > 0 {
-			width = int(float32(height) * ratio)
-		} else {
-			apiRequest.Error(http.StatusBadRequest, "either width or height must be provided if using ratio")
+		if errors.Is(err, ErrRenderOverloaded) {
+			gc.Header("Retry-After", pluto.renderLimiter.RetryAfter())
+			apiRequest.Error(http.StatusServiceUnavailable, err.Error())
 			return
 		}
-	}
-
-	var paramCode, paramValues string
-	if fitStr != "" {
-		paramCode += "f"
-		switch fitStr {
-		case "cover":
-			paramValues += "01"
-		default:
-			paramValues += "00"
+		var apiErr *ApiTxError
+		if errors.As(err, &apiErr) {
+			apiRequest.Error(apiErr.Code, apiErr.Err.Error())
+			return
 		}
+		apiRequest.InternalServerError()
+		return
 	}
-	if quality < 100 {
-		paramCode += "q"
-		paramValues += fmt.Sprintf("%02x", quality) // 0 - 99
+
+	contentType := imageTypeMimeType(opts.Type)
+	gc.Header("Content-Type", contentType)
+	gc.Header("Cache-Control", pluto.cacheControl())
+	gc.Header("Content-Disposition", `inline; filename="`+cacheFileName+`"`)
+	gc.Data(http.StatusOK, contentType, data)
+}
+
+// sourceOpaque reports whether the master of an image has no transparent pixels.
+// Results are kept by master file name, a replaced master gets a new name.
+func (pluto *Pluto) sourceOpaque(ctx context.Context, record *imageRecord) (bool, error) {
+	if record.MimeType == "image/jpeg" {
+		return true, nil
 	}
-	if width > 0 {
-		// TODO: Limit to configured max size
-		paramCode += "w"
-		paramValues += fmt.Sprintf("%04x", width) // max 65535 pixel
+	if opaque, ok := pluto.opaque.Load(record.GenFileName); ok {
+		return opaque.(bool), nil
 	}
-	if height > 0 {
-		// TODO: Limit to configured max size
-		paramCode += "h"
-		paramValues += fmt.Sprintf("%04x", height) // max 65535 pixel
+
+	release, err := pluto.renderLimiter.Acquire(ctx)
+	if err != nil {
+		return false, err
 	}
+	defer release()
 
-	if hasRatio {
-		paramCode += "r"
-		paramValues += "_" + EncodeFloat32ForPath(ratio)
+	data, err := pluto.ImageStorage.Get(ctx, record.GenFileName)
+	if err != nil {
+		return false, err
+	}
+	img, err := decodeImage(data, record.MimeType)
+	if err != nil {
+		return false, err
 	}
 
-	imageReceipt := fmt.Sprintf("%s_%s_%s", imageUuid, paramCode, paramValues)
-	cacheFileName := imageReceipt + "." + fileTypeStr
-	cacheFilePath := filepath.Join(PlutoInstance.Config.PlutoCacheDir, cacheFileName)
+	opaque := isOpaque(img)
+	pluto.opaque.Store(record.GenFileName, opaque)
+	return opaque, nil
+}
 
-	/* Previous version without using ETag in Header
-	if _, err := os.Stat(cacheFilePath); err == nil {
-		gc.Header("Content-Disposition", `inline; filename="`+cacheFileName+`"`)
-		gc.File(cacheFilePath)
-		return
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
 	}
-	*/
-
-	// Check if file exist, if so deliver that file
-	if _, err := os.Stat(cacheFilePath); err == nil {
-		serveCacheFile(gc, cacheFilePath, cacheFileName)
-		return
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
 	}
+	return true
+}
 
-	var fileName, genFileName, mimeType string
-	var focusX, focusY *float32
-	sql := fmt.Sprintf(`
-		SELECT file_name, gen_file_name, mime_type, focus_x, focus_y FROM %s.pluto_image WHERE uuid = $1`,
-		PlutoInstance.DbSchema)
-	err := pool.QueryRow(ctx, sql, imageUuid).Scan(&fileName, &genFileName, &mimeType, &focusX, &focusY)
+// renderImage transforms and encodes an image according to opts and stores the
+// result as cache file. record is loaded if nil.
+func (pluto *Pluto) renderImage(
+	ctx context.Context,
+	imageUuid string,
+	opts ImageOptions,
+	record *imageRecord,
+) ([]byte, error) {
+	release, err := pluto.renderLimiter.Acquire(ctx)
 	if err != nil {
-		apiRequest.Error(http.StatusNotFound, "Image not found")
-		return
+		return nil, err
 	}
+	defer release()
 
-	imgPath := filepath.Join(PlutoInstance.Config.PlutoImageDir, genFileName)
-	fileBytes, err := os.ReadFile(imgPath)
+	if record == nil {
+		record, err = pluto.loadImageRecord(ctx, imageUuid)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, ApiErrNotFound("Image not found")
+		}
+	}
+
+	fileBytes, err := pluto.ImageStorage.Get(ctx, record.GenFileName)
 	if err != nil {
-		apiRequest.Error(http.StatusInternalServerError, "Image read error")
-		return
+		return nil, ApiErrInternal("Image read error")
 	}
 
 	img, _, err := image.Decode(bytes.NewReader(fileBytes))
 	if err != nil {
-		apiRequest.Error(http.StatusInternalServerError, "Image decode error")
-		return
+		return nil, ApiErrInternal("Image decode error")
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
-	if width > 0 || height > 0 || hasRatio {
+	if opts.Resizes() {
 		fx := float32(0.5)
 		fy := float32(0.5)
-		if focusX != nil {
-			fx = *focusX
+		if record.FocusX != nil {
+			fx = *record.FocusX
+		}
+		if record.FocusY != nil {
+			fy = *record.FocusY
 		}
-		if focusY != nil {
-			fy = *focusY
+		switch opts.Fit {
+		case "contain":
+			img = ContainImage(img, opts.Ratio, opts.Width, opts.Height, opts.EffectiveBackground())
+		case "fill":
+			img = FillImage(img, opts.Ratio, opts.Width, opts.Height)
+		case "inside":
+			img = FitInside(img, opts.Ratio, opts.Width, opts.Height)
+		case "outside":
+			img = FitOutside(img, opts.Ratio, opts.Width, opts.Height)
+		default:
+			img = CropWithFocus(img, opts.Ratio, fx, fy, opts.Width, opts.Height)
 		}
-		img = CropWithFocus(img, ratio, fx, fy, width, height)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	var buf bytes.Buffer
-	switch fileTypeStr {
+	switch opts.Type {
 	case "jpg":
-		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.Quality})
 	case "png":
 		err = png.Encode(&buf, img)
 	case "webp":
 		var options webp.Options
-		if lossless {
+		if opts.Lossless {
 			options = webp.Options{Lossless: true}
 		} else {
-			options = webp.Options{Quality: float32(quality), Lossless: false}
+			options = webp.Options{Quality: float32(opts.Quality), Lossless: false}
 		}
 		err = webp.Encode(&buf, img, &options)
+	case "avif":
+		// The AVIF encoder treats quality 100 as lossless
+		options := avif.Options{Quality: opts.Quality, QualityAlpha: opts.Quality, Speed: opts.Speed}
+		if opts.Lossless {
+			options.Quality = 100
+			options.QualityAlpha = 100
+		}
+		err = avif.Encode(&buf, img, options)
 	default:
-		apiRequest.Error(http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported image format: image/%s", fileTypeStr))
-		return
+		return nil, NewApiTxError(http.StatusUnsupportedMediaType, "unsupported image format: image/%s", opts.Type)
 	}
 	if err != nil {
-		apiRequest.Error(http.StatusUnsupportedMediaType, "failed to encode image")
-		return
+		return nil, NewApiTxError(http.StatusUnsupportedMediaType, "failed to encode image")
 	}
 
-	// Save to cache
-	err = os.WriteFile(cacheFilePath, buf.Bytes(), 0644)
+	// Save to cache, the row is only inserted once per receipt and type
+	err = pluto.CacheStorage.Put(ctx, opts.CacheFileName(imageUuid), buf.Bytes(), imageTypeMimeType(opts.Type))
 	if err == nil {
-		sql = fmt.Sprintf(`
+		sql := fmt.Sprintf(`
 				INSERT INTO %s.pluto_cache (receipt, pluto_image_uuid, mime_type)
-				VALUES ($1, $2::uuid, $3)`,
-			PlutoInstance.DbSchema)
-		_, _ = pool.Exec(ctx, sql, imageReceipt, imageUuid, fileTypeStr)
+				SELECT $1::text, $2::uuid, $3::text
+				WHERE NOT EXISTS (SELECT 1 FROM %s.pluto_cache WHERE receipt = $1::text AND mime_type = $3::text)`,
+			pluto.DbSchema, pluto.DbSchema)
+		_, _ = pluto.DbPool.Exec(ctx, sql, opts.Receipt(imageUuid), imageUuid, opts.Type)
 	}
 
-	gc.Header("Content-Type", "image/"+fileTypeStr)
-	gc.Header("Content-Disposition", `inline; filename="`+cacheFileName+`"`)
-	gc.Data(http.StatusOK, "image/"+fileTypeStr, buf.Bytes())
+	return buf.Bytes(), nil
 }
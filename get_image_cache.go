@@ -8,26 +8,30 @@ import (
 	"github.com/sndcds/grains/grains_api"
 )
 
-func getImageCache(gc *gin.Context) {
+func (pluto *Pluto) getImageCache(gc *gin.Context) {
 	ctx := gc.Request.Context()
-	dbPool := PlutoInstance.DbPool
-	dbSchema := PlutoInstance.DbSchema
+	dbPool := pluto.DbPool
+	dbSchema := pluto.DbSchema
 	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-cache")
 
-	imageId, ok := ParamInt(gc, "imageId")
-	if !ok {
-		apiRequest.Error(http.StatusBadRequest, "imageId is required")
+	imageUuid := gc.Param("imageUuid")
+	if imageUuid == "" {
+		apiRequest.Error(http.StatusBadRequest, "imageUuid is required")
+		return
+	}
+
+	if !pluto.authorizeImage(gc, apiRequest, ActionMeta, imageUuid) {
 		return
 	}
 
 	query := fmt.Sprintf(`
-        SELECT id, receipt, image_id, created_at, mime_type
+        SELECT id, receipt, pluto_image_uuid, created_at, mime_type
         FROM %s.pluto_cache
-        WHERE image_id = $1
+        WHERE pluto_image_uuid = $1::uuid
         ORDER BY created_at DESC
     `, dbSchema)
 
-	rows, err := dbPool.Query(ctx, query, imageId)
+	rows, err := dbPool.Query(ctx, query, imageUuid)
 	if err != nil {
 		apiRequest.DatabaseError()
 		return
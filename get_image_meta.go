@@ -11,11 +11,11 @@ import (
 )
 
 // API: GET /image/:context/:contextId/:identifier/meta
-func getImageMeta(gc *gin.Context) {
+func (pluto *Pluto) getImageMeta(gc *gin.Context) {
 	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-meta")
 	ctx := gc.Request.Context()
-	dbPool := PlutoInstance.DbPool
-	dbSchema := PlutoInstance.DbSchema
+	dbPool := pluto.DbPool
+	dbSchema := pluto.DbSchema
 
 	context := gc.Param("context")
 	if context == "" {
@@ -46,7 +46,7 @@ func getImageMeta(gc *gin.Context) {
             pi.description,
             pi.license, 
             pi.exif, 
-            pi.expiration_date, 
+            pi.expiration_date::text, 
             pi.creator_name, 
             pi.copyright,
             pi.focus_x, 
@@ -90,5 +90,10 @@ func getImageMeta(gc *gin.Context) {
 		return
 	}
 
+	link := ImageLink{ImageUuid: *meta.Uuid, Context: context, ContextUuid: contextUuid, Identifier: identifier}
+	if !pluto.authorize(gc, apiRequest, ActionMeta, link) {
+		return
+	}
+
 	apiRequest.Success(http.StatusOK, meta, "")
 }
@@ -0,0 +1,74 @@
+package pluto
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+)
+
+// API: GET /image/original/:uuid
+func (pluto *Pluto) getImageOriginal(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-original")
+	ctx := gc.Request.Context()
+
+	imageUuid := gc.Param("uuid")
+	if imageUuid == "" {
+		apiRequest.Error(http.StatusBadRequest, "uuid is required")
+		return
+	}
+
+	if !pluto.authorizeImage(gc, apiRequest, ActionOriginal, imageUuid) {
+		return
+	}
+
+	query := fmt.Sprintf(
+		`SELECT file_name, original_gen_file_name, original_mime_type
+		 FROM %s.pluto_image WHERE uuid = $1::uuid`,
+		pluto.DbSchema)
+
+	var fileName, originalGenFileName, originalMimeType *string
+	err := pluto.DbPool.QueryRow(ctx, query, imageUuid).Scan(&fileName, &originalGenFileName, &originalMimeType)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			apiRequest.Error(http.StatusNotFound, "image not found")
+			return
+		}
+		apiRequest.DatabaseError()
+		return
+	}
+
+	// Images uploaded before originals were kept have none
+	if originalGenFileName == nil || *originalGenFileName == "" {
+		apiRequest.Error(http.StatusNotFound, "original not available")
+		return
+	}
+
+	data, err := pluto.ImageStorage.Get(ctx, *originalGenFileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			apiRequest.Error(http.StatusNotFound, "original not found")
+			return
+		}
+		apiRequest.InternalServerError()
+		return
+	}
+
+	contentType := "application/octet-stream"
+	if originalMimeType != nil && *originalMimeType != "" {
+		contentType = *originalMimeType
+	}
+
+	downloadName := *originalGenFileName
+	if fileName != nil && *fileName != "" {
+		downloadName = *fileName
+	}
+
+	gc.Header("Cache-Control", "private, no-store")
+	gc.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", downloadName))
+	gc.Data(http.StatusOK, contentType, data)
+}
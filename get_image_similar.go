@@ -0,0 +1,150 @@
+package pluto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+	"github.com/sndcds/grains/grains_file"
+)
+
+// API: GET /image/similar/:uuid?distance=10
+func (pluto *Pluto) getSimilarImages(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "get-pluto-similar-images")
+
+	imageUuid := gc.Param("uuid")
+	if validateUuid(imageUuid) != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	maxDistance, ok := similarDistance(gc)
+	if !ok {
+		apiRequest.Error(http.StatusBadRequest, fmt.Sprintf("distance must be between 0 and %d", MaxSimilarDistance))
+		return
+	}
+
+	if !pluto.authorizeImage(gc, apiRequest, ActionMeta, imageUuid) {
+		return
+	}
+
+	hash, err := pluto.imagePHash(gc.Request.Context(), imageUuid)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			apiRequest.Error(http.StatusNotFound, "image not found")
+		case errors.Is(err, ErrNoImageHash):
+			apiRequest.Error(http.StatusNotFound, "image has no perceptual hash")
+		default:
+			apiRequest.DatabaseError()
+		}
+		return
+	}
+
+	pluto.writeSimilarImages(gc, apiRequest, hash, maxDistance, imageUuid)
+}
+
+// API: POST /image/:context/:contextUuid/:identifier/similar, multipart form with file
+//
+// Finds the images similar to an upload before it is added to the link, nothing is stored.
+func (pluto *Pluto) postSimilarImages(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "post-pluto-similar-images")
+	ctx := gc.Request.Context()
+
+	context, contextUuid, identifier := gc.Param("context"), gc.Param("contextUuid"), gc.Param("identifier")
+	if _, ok := pluto.authorizeWrite(gc, apiRequest, ActionUpload, context, contextUuid, identifier); !ok {
+		return
+	}
+
+	maxDistance, ok := similarDistance(gc)
+	if !ok {
+		apiRequest.Error(http.StatusBadRequest, fmt.Sprintf("distance must be between 0 and %d", MaxSimilarDistance))
+		return
+	}
+
+	file, err := gc.FormFile("file")
+	if err != nil {
+		apiRequest.Error(http.StatusBadRequest, "file is required")
+		return
+	}
+	if file.Size > pluto.Config.PlutoMaxImageSize {
+		apiRequest.Error(http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		apiRequest.InternalServerError()
+		return
+	}
+	defer src.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, src); err != nil {
+		apiRequest.InternalServerError()
+		return
+	}
+
+	head := buf.Bytes()
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	mimeType := http.DetectContentType(head)
+	if grains_file.IsAVIF(head) {
+		mimeType = "image/avif"
+	}
+
+	// Decoding shares the render limit with getImage
+	release, err := pluto.renderLimiter.Acquire(ctx)
+	if err != nil {
+		if errors.Is(err, ErrRenderOverloaded) {
+			gc.Header("Retry-After", pluto.renderLimiter.RetryAfter())
+			apiRequest.Error(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		apiRequest.Error(http.StatusRequestTimeout, "request cancelled")
+		return
+	}
+	hash, err := ImageHash(buf.Bytes(), mimeType)
+	release()
+	if err != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid image")
+		return
+	}
+
+	pluto.writeSimilarImages(gc, apiRequest, hash, maxDistance, "")
+}
+
+// writeSimilarImages answers with the similar images the request may see, the
+// limit applies to these
+func (pluto *Pluto) writeSimilarImages(
+	gc *gin.Context,
+	apiRequest *grains_api.Request,
+	hash uint64,
+	maxDistance int,
+	excludeUuid string,
+) {
+	allow := func(imageUuid string) (bool, error) {
+		return pluto.allowImage(gc, ActionMeta, imageUuid)
+	}
+	similar, err := pluto.findSimilarImages(gc.Request.Context(), hash, maxDistance, excludeUuid, allow)
+	if err != nil {
+		apiRequest.DatabaseError()
+		return
+	}
+
+	apiRequest.Success(http.StatusOK, similar, "")
+}
+
+func similarDistance(gc *gin.Context) (int, bool) {
+	distance, ok := GetQueryIntDefault(gc, "distance", DefaultSimilarDistance)
+	if !ok || distance < 0 || distance > MaxSimilarDistance {
+		return 0, false
+	}
+	return distance, true
+}
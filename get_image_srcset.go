@@ -0,0 +1,431 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+)
+
+// maxSrcsetWidths limits the widths of a manifest, each one is a variant to render
+const maxSrcsetWidths = 16
+
+type SrcsetUrl struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height,omitempty"`
+	Url    string `json:"url"`
+}
+
+type SrcsetSource struct {
+	Type   string      `json:"type"`
+	Srcset string      `json:"srcset"`
+	Urls   []SrcsetUrl `json:"urls"`
+}
+
+type SrcsetManifest struct {
+	Uuid           string         `json:"uuid"`
+	Width          int            `json:"width"`
+	Height         int            `json:"height"`
+	FocusX         *float64       `json:"focus_x,omitempty"`
+	FocusY         *float64       `json:"focus_y,omitempty"`
+	ObjectPosition string         `json:"object_position"`
+	Sizes          string         `json:"sizes"`
+	Sources        []SrcsetSource `json:"sources"`
+	Fallback       SrcsetUrl      `json:"fallback"`
+}
+
+// API: GET /image/srcset/:uuid
+func (pluto *Pluto) getImageSrcset(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-srcset")
+
+	imageUuid := gc.Param("uuid")
+	if imageUuid == "" {
+		apiRequest.Error(http.StatusBadRequest, "uuid is required")
+		return
+	}
+
+	if !pluto.authorizeImage(gc, apiRequest, ActionMeta, imageUuid) {
+		return
+	}
+
+	pluto.writeImageSrcset(gc, apiRequest, imageUuid)
+}
+
+// API: GET /image/meta/:context/:contextUuid/:identifier/srcset
+func (pluto *Pluto) getImageSrcsetByContext(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-srcset")
+	ctx := gc.Request.Context()
+
+	link := ImageLink{Context: gc.Param("context"), ContextUuid: gc.Param("contextUuid"), Identifier: gc.Param("identifier")}
+
+	query := fmt.Sprintf(
+		`SELECT pluto_image_uuid
+		 FROM %s.pluto_image_link
+		 WHERE context = $1 AND context_uuid = $2::uuid AND identifier = $3`,
+		pluto.DbSchema)
+
+	err := pluto.DbPool.QueryRow(
+		ctx, query, link.Context, link.ContextUuid, link.Identifier).Scan(&link.ImageUuid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			apiRequest.Error(http.StatusNotFound, "image not found")
+			return
+		}
+		apiRequest.DatabaseError()
+		return
+	}
+
+	if !pluto.authorize(gc, apiRequest, ActionMeta, link) {
+		return
+	}
+
+	pluto.writeImageSrcset(gc, apiRequest, link.ImageUuid)
+}
+
+func (pluto *Pluto) writeImageSrcset(gc *gin.Context, apiRequest *grains_api.Request, imageUuid string) {
+	ctx := gc.Request.Context()
+	query := gc.Request.URL.Query()
+
+	var manifest *SrcsetManifest
+	if pluto.Config.PlutoPresetsOnly {
+		// getImage serves presets only, a preset defines the widths and the type
+		presetName := query.Get("preset")
+		if presetName == "" {
+			apiRequest.Error(http.StatusBadRequest, ErrPresetRequired.Error())
+			return
+		}
+		for _, key := range append([]string{"widths", "types"}, imageOptionKeys...) {
+			if query.Has(key) {
+				apiRequest.Error(http.StatusBadRequest, key+" is not allowed, only presets are served")
+				return
+			}
+		}
+		var err error
+		manifest, err = pluto.BuildPresetSrcsetManifest(ctx, imageUuid, presetName)
+		if err != nil {
+			writeSrcsetError(apiRequest, err)
+			return
+		}
+	} else {
+		opts, widths, types, err := pluto.srcsetParams(query)
+		if err != nil {
+			if errors.Is(err, ErrUnknownPreset) {
+				apiRequest.Error(http.StatusNotFound, err.Error())
+				return
+			}
+			apiRequest.Error(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		manifest, err = pluto.BuildSrcsetManifest(ctx, imageUuid, opts, widths, types)
+		if err != nil {
+			writeSrcsetError(apiRequest, err)
+			return
+		}
+	}
+
+	if sizes := gc.Query("sizes"); sizes != "" {
+		manifest.Sizes = sizes
+	}
+
+	apiRequest.Success(http.StatusOK, manifest, "")
+}
+
+func writeSrcsetError(apiRequest *grains_api.Request, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		apiRequest.Error(http.StatusNotFound, "image not found")
+	case errors.Is(err, ErrUnknownPreset):
+		apiRequest.Error(http.StatusNotFound, err.Error())
+	default:
+		apiRequest.InternalServerError()
+	}
+}
+
+// srcsetParams parses the options, widths and types of a manifest request. The
+// manifest signs its urls, so with a signature secret only the configured widths,
+// presets and image types can be used, arbitrary parameters would make it a
+// signing service for any transformation.
+func (pluto *Pluto) srcsetParams(query url.Values) (ImageOptions, []int, []string, error) {
+	signed := pluto.Config.PlutoSignatureSecret != ""
+
+	if signed && query.Has("widths") {
+		return ImageOptions{}, nil, nil, errors.New("widths parameter is not allowed with signed urls")
+	}
+	widths, err := parseIntList(query.Get("widths"), pluto.Config.PlutoSrcsetWidths)
+	if err != nil {
+		return ImageOptions{}, nil, nil, errors.New("invalid widths parameter")
+	}
+	if len(widths) > maxSrcsetWidths {
+		return ImageOptions{}, nil, nil, fmt.Errorf("too many widths, at most %d are allowed", maxSrcsetWidths)
+	}
+
+	types := pluto.Config.PlutoSrcsetTypes
+	if typesStr := query.Get("types"); typesStr != "" {
+		types = nil
+		for _, t := range strings.Split(typesStr, ",") {
+			if !isImageType(t) {
+				return ImageOptions{}, nil, nil, errors.New("invalid types parameter, must be a list of 'jpg', 'png', 'webp' or 'avif'")
+			}
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+
+	// The transformation parameters of a preset, or with no secret the ones of the
+	// request, are passed through to every url
+	var optsQuery url.Values
+	if presetName := query.Get("preset"); presetName != "" {
+		optsQuery, err = pluto.resolveImageQuery(presetName, query)
+		if err != nil {
+			return ImageOptions{}, nil, nil, err
+		}
+	} else if signed {
+		for _, key := range imageOptionKeys {
+			if query.Has(key) {
+				return ImageOptions{}, nil, nil, errors.New("transformation parameters are not allowed, use a preset")
+			}
+		}
+		optsQuery = url.Values{}
+	} else {
+		optsQuery = url.Values{}
+		for _, key := range imageOptionKeys {
+			if values, ok := query[key]; ok {
+				optsQuery[key] = values
+			}
+		}
+	}
+	optsQuery.Del("width")
+	optsQuery.Del("height")
+	optsQuery.Del("dpr")
+
+	opts, err := pluto.ParseImageOptions(optsQuery)
+	if err != nil {
+		return ImageOptions{}, nil, nil, err
+	}
+	return opts, widths, types, nil
+}
+
+// BuildSrcsetManifest builds the urls of an image for the given widths and types.
+// Widths that would upscale the stored image are left out.
+func (pluto *Pluto) BuildSrcsetManifest(
+	ctx context.Context,
+	imageUuid string,
+	opts ImageOptions,
+	widths []int,
+	types []string,
+) (*SrcsetManifest, error) {
+	manifest, err := pluto.loadSrcsetManifest(ctx, imageUuid)
+	if err != nil {
+		return nil, err
+	}
+	maxWidth := manifest.maxWidth(opts)
+
+	for _, t := range types {
+		source := SrcsetSource{Type: imageTypeMimeType(t)}
+		srcset := []string{}
+		seen := map[int]bool{}
+
+		for _, w := range candidateWidths(widths, maxWidth) {
+			variant := opts
+			variant.Type = t
+			variant.Width = w
+			variant.Height = 0
+
+			// Normalize first, snapping may change the width
+			normalized, err := pluto.ParseImageOptions(variant.Query())
+			if err != nil || normalized.Width > maxWidth {
+				continue
+			}
+			width, height := normalized.Width, normalized.Height
+			if width == 0 {
+				// Stored image smaller than all widths, delivered in its own size
+				width = maxWidth
+				if opts.HasRatio {
+					height = int(float32(width) / opts.Ratio)
+				}
+			}
+			if seen[width] {
+				continue
+			}
+			seen[width] = true
+
+			imageUrl, err := pluto.SignedURL(imageUuid, normalized)
+			if err != nil {
+				return nil, err
+			}
+			source.Urls = append(source.Urls, SrcsetUrl{Width: width, Height: height, Url: imageUrl})
+			srcset = append(srcset, fmt.Sprintf("%s %dw", imageUrl, width))
+		}
+
+		source.Srcset = strings.Join(srcset, ", ")
+		manifest.Sources = append(manifest.Sources, source)
+	}
+
+	// The last type, usually jpg, is the fallback for the <img> element
+	if len(manifest.Sources) > 0 {
+		last := manifest.Sources[len(manifest.Sources)-1]
+		if len(last.Urls) > 0 {
+			manifest.Fallback = last.Urls[len(last.Urls)-1]
+		}
+	}
+
+	largest := manifest.Fallback.Width
+	if largest == 0 {
+		largest = maxWidth
+	}
+	manifest.Sizes = fmt.Sprintf("(max-width: %dpx) 100vw, %dpx", largest, largest)
+
+	return manifest, nil
+}
+
+// BuildPresetSrcsetManifest builds the urls of an image for a preset at the
+// supported device pixel ratios, for deployments serving presets only. Ratios that
+// would upscale the stored image are left out.
+func (pluto *Pluto) BuildPresetSrcsetManifest(
+	ctx context.Context,
+	imageUuid string,
+	presetName string,
+) (*SrcsetManifest, error) {
+	presetQuery, err := pluto.PresetQuery(presetName)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := pluto.ParseImageOptions(presetQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := pluto.loadSrcsetManifest(ctx, imageUuid)
+	if err != nil {
+		return nil, err
+	}
+	maxWidth := manifest.maxWidth(opts)
+
+	// type=auto is negotiated by getImage, the source has no type then
+	source := SrcsetSource{}
+	if opts.Type != "auto" {
+		source.Type = imageTypeMimeType(opts.Type)
+	}
+	presetUrl := pluto.PresetURL(imageUuid, presetName)
+	srcset := []string{}
+
+	for _, dpr := range allowedDprs {
+		variantQuery := url.Values{}
+		for key, values := range presetQuery {
+			variantQuery[key] = values
+		}
+		variantQuery.Set("dpr", strconv.FormatFloat(dpr, 'g', -1, 64))
+		variant, err := pluto.ParseImageOptions(variantQuery)
+		if err != nil {
+			continue
+		}
+
+		imageUrl := presetUrl
+		if dpr != 1 {
+			// Presets without width deliver the image in its own size, at any dpr
+			if opts.Width == 0 || variant.Width > maxWidth {
+				continue
+			}
+			imageUrl += "?dpr=" + variantQuery.Get("dpr")
+		}
+
+		width := variant.Width
+		if width == 0 {
+			width = maxWidth
+		}
+		source.Urls = append(source.Urls, SrcsetUrl{Width: width, Height: variant.Height, Url: imageUrl})
+		srcset = append(srcset, fmt.Sprintf("%s %sx", imageUrl, variantQuery.Get("dpr")))
+	}
+
+	if len(source.Urls) == 0 {
+		return nil, fmt.Errorf("invalid preset %s", presetName)
+	}
+	source.Srcset = strings.Join(srcset, ", ")
+	manifest.Sources = []SrcsetSource{source}
+	manifest.Fallback = source.Urls[0]
+
+	cssWidth := opts.Width
+	if cssWidth == 0 {
+		cssWidth = maxWidth
+	}
+	manifest.Sizes = fmt.Sprintf("%dpx", cssWidth)
+
+	return manifest, nil
+}
+
+// loadSrcsetManifest returns a manifest with the size and focus of an image, without sources
+func (pluto *Pluto) loadSrcsetManifest(ctx context.Context, imageUuid string) (*SrcsetManifest, error) {
+	manifest := SrcsetManifest{Uuid: imageUuid}
+
+	query := fmt.Sprintf(
+		`SELECT width, height, focus_x, focus_y FROM %s.pluto_image WHERE uuid = $1::uuid`,
+		pluto.DbSchema)
+	err := pluto.DbPool.QueryRow(ctx, query, imageUuid).Scan(
+		&manifest.Width, &manifest.Height, &manifest.FocusX, &manifest.FocusY)
+	if err != nil {
+		return nil, err
+	}
+
+	fx, fy := 0.5, 0.5
+	if manifest.FocusX != nil {
+		fx = *manifest.FocusX
+	}
+	if manifest.FocusY != nil {
+		fy = *manifest.FocusY
+	}
+	manifest.ObjectPosition = fmt.Sprintf("%g%% %g%%", fx*100, fy*100)
+
+	return &manifest, nil
+}
+
+// maxWidth returns the largest width available without upscaling, cropping to a
+// ratio may reduce it
+func (manifest *SrcsetManifest) maxWidth(opts ImageOptions) int {
+	maxWidth := manifest.Width
+	if opts.HasRatio && manifest.Height > 0 {
+		maxWidth = min(maxWidth, int(float32(manifest.Height)*opts.Ratio))
+	}
+	return maxWidth
+}
+
+// candidateWidths returns the widths not larger than maxWidth. If all are larger it
+// returns 0, the image is delivered in its own size then.
+func candidateWidths(widths []int, maxWidth int) []int {
+	result := []int{}
+	for _, w := range widths {
+		if w > 0 && w <= maxWidth && !slices.Contains(result, w) {
+			result = append(result, w)
+		}
+	}
+	if len(result) == 0 && maxWidth > 0 {
+		result = append(result, 0)
+	}
+	sort.Ints(result)
+	return result
+}
+
+func parseIntList(s string, def []int) ([]int, error) {
+	if s == "" {
+		return def, nil
+	}
+	var list []int
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
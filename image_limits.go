@@ -0,0 +1,157 @@
+package pluto
+
+import (
+	"errors"
+	"math"
+)
+
+// Dimension modes for requested sizes not matching the configured limits
+const (
+	DimensionModeSnap   = "snap"
+	DimensionModeReject = "reject"
+)
+
+// maxEncodablePx is the largest edge the cache receipt can encode (4 hex digits)
+const maxEncodablePx = 65535
+
+// Supported aspect ratios, requested ratios are rounded to ratioPrecision
+const (
+	minRatio       = 0.1
+	maxRatio       = 10.0
+	ratioPrecision = 100
+)
+
+// limitDimensions enforces the configured maximum size, width/height step and
+// allowlists on width and height, and the ratio allowlist. Depending on
+// PlutoDimensionMode non-conforming requests are snapped to the next allowed value
+// or rejected. With a ratio the width drives: a height alone gives the width, the
+// snapped width gives the height. So every edge and ratio comes from a bounded set.
+func (opts *ImageOptions) limitDimensions(config Config) error {
+	maxPx := config.PlutoMaxImagePx
+	if maxPx <= 0 || maxPx > maxEncodablePx {
+		maxPx = maxEncodablePx
+	}
+
+	if opts.Width < 0 || opts.Height < 0 {
+		return errors.New("width and height must not be negative")
+	}
+	reject := config.PlutoDimensionMode == DimensionModeReject
+
+	w, h := opts.Width, opts.Height
+	if opts.HasRatio {
+		ratio, err := limitRatio(opts.Ratio, config.PlutoAllowedRatios, reject)
+		if err != nil {
+			return err
+		}
+		opts.Ratio = ratio
+		if w == 0 && h > 0 {
+			w = max(1, int(float32(h)*ratio))
+		}
+	}
+
+	if w > 0 {
+		w = snapEdgeUp(w, config.PlutoAllowedWidths, config.PlutoDimensionStep, maxPx)
+	}
+	if h > 0 && !opts.HasRatio {
+		h = snapEdgeUp(h, config.PlutoAllowedHeights, config.PlutoDimensionStep, maxPx)
+	}
+	if reject && ((opts.Width > 0 && w != opts.Width) || (!opts.HasRatio && h != opts.Height)) {
+		return errors.New("requested width or height is not allowed")
+	}
+
+	// The height follows the width, shrunk if it gets too large for portrait formats
+	if opts.HasRatio && w > 0 {
+		h = int(float32(w) / opts.Ratio)
+		if h > maxPx {
+			w = snapEdgeDown(int(float32(maxPx)*opts.Ratio), config.PlutoAllowedWidths, config.PlutoDimensionStep)
+			h = min(maxPx, int(float32(w)/opts.Ratio))
+		}
+	}
+
+	opts.Width, opts.Height = max(w, 0), max(h, 0)
+	return nil
+}
+
+// limitRatio rounds a ratio and snaps it to the nearest allowed ratio, a ratio not
+// in the allowlist is an error in reject mode.
+func limitRatio(ratio float32, allowed []string, reject bool) (float32, error) {
+	if ratio < minRatio || ratio > maxRatio {
+		return 0, errors.New("ratio out of range")
+	}
+	ratio = float32(math.Round(float64(ratio)*ratioPrecision) / ratioPrecision)
+
+	if len(allowed) == 0 {
+		return ratio, nil
+	}
+
+	best := float32(0)
+	bestDiff := math.Inf(1)
+	for _, a := range allowed {
+		allowedRatio, err := ParseAspectRatio(a)
+		if err != nil {
+			continue
+		}
+		allowedRatio = float32(math.Round(float64(allowedRatio)*ratioPrecision) / ratioPrecision)
+		if diff := math.Abs(float64(allowedRatio - ratio)); diff < bestDiff {
+			best, bestDiff = allowedRatio, diff
+		}
+	}
+	if reject && bestDiff > 0 {
+		return 0, errors.New("requested ratio is not allowed")
+	}
+
+	return best, nil
+}
+
+// snapEdgeUp returns the smallest allowed edge greater or equal than v, limited to maxPx
+func snapEdgeUp(v int, allowed []int, step int, maxPx int) int {
+	if len(allowed) > 0 {
+		// allowed is sorted ascending
+		best := 0
+		for _, a := range allowed {
+			if a > maxPx {
+				break
+			}
+			best = a
+			if a >= v {
+				return a
+			}
+		}
+		if best > 0 {
+			return best
+		}
+		return min(v, maxPx)
+	}
+
+	if step > 0 {
+		snapped := (v + step - 1) / step * step
+		if snapped > maxPx {
+			snapped = maxPx / step * step
+		}
+		if snapped > 0 {
+			return snapped
+		}
+	}
+
+	return min(v, maxPx)
+}
+
+// snapEdgeDown returns the largest allowed edge less or equal than v
+func snapEdgeDown(v int, allowed []int, step int) int {
+	if len(allowed) > 0 {
+		best := allowed[0]
+		for _, a := range allowed {
+			if a > v {
+				break
+			}
+			best = a
+		}
+		return best
+	}
+
+	if step > 0 && v >= step {
+		return v / step * step
+	}
+
+	return max(v, 1)
+}
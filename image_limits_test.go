@@ -0,0 +1,86 @@
+package pluto
+
+import "testing"
+
+func TestLimitDimensions(t *testing.T) {
+	step80 := func(c *Config) { c.PlutoDimensionStep = 80 }
+	widths := func(c *Config) { c.PlutoAllowedWidths = []int{320, 640, 1280} }
+	reject := func(c *Config) { c.PlutoDimensionMode = DimensionModeReject }
+	ratios := func(c *Config) { c.PlutoAllowedRatios = []string{"1:1", "16:9"} }
+
+	tests := []struct {
+		name      string
+		configure []func(*Config)
+		opts      ImageOptions
+		width     int
+		height    int
+		ratio     float32
+		wantErr   bool
+	}{
+		{"unlimited", nil, ImageOptions{Width: 333, Height: 201}, 333, 201, 0, false},
+		{"max size", nil, ImageOptions{Width: 5000, Height: 9000}, 4096, 4096, 0, false},
+		{"negative", nil, ImageOptions{Width: -1}, 0, 0, 0, true},
+		{"step up", []func(*Config){step80}, ImageOptions{Width: 333, Height: 201}, 400, 240, 0, false},
+		{"step max", []func(*Config){step80}, ImageOptions{Width: 5000}, 4080, 0, 0, false},
+		{"allowlist up", []func(*Config){widths}, ImageOptions{Width: 333}, 640, 0, 0, false},
+		{"allowlist small", []func(*Config){widths}, ImageOptions{Width: 100}, 320, 0, 0, false},
+		{"allowlist largest", []func(*Config){widths}, ImageOptions{Width: 2000}, 1280, 0, 0, false},
+		{"reject step", []func(*Config){step80, reject}, ImageOptions{Width: 333}, 0, 0, 0, true},
+		{"reject step ok", []func(*Config){step80, reject}, ImageOptions{Width: 400, Height: 240}, 400, 240, 0, false},
+		{"reject height", []func(*Config){step80, reject}, ImageOptions{Height: 201}, 0, 0, 0, true},
+		{"reject allowlist", []func(*Config){widths, reject}, ImageOptions{Width: 333}, 0, 0, 0, true},
+		{"ratio width", nil, ImageOptions{Width: 640, Ratio: 2, HasRatio: true}, 640, 320, 2, false},
+		{"ratio height", nil, ImageOptions{Height: 360, Ratio: 2, HasRatio: true}, 720, 360, 2, false},
+		{"ratio rounded", nil, ImageOptions{Width: 640, Ratio: 16.0 / 9, HasRatio: true}, 640, 359, 1.78, false},
+		{"ratio height snapped width", []func(*Config){step80}, ImageOptions{Height: 100, Ratio: 2, HasRatio: true}, 240, 120, 2, false},
+		{"ratio portrait max", nil, ImageOptions{Width: 4000, Ratio: 0.5, HasRatio: true}, 2048, 4096, 0.5, false},
+		{"ratio out of range", nil, ImageOptions{Width: 640, Ratio: 20, HasRatio: true}, 0, 0, 0, true},
+		{"ratio allowlist snap", []func(*Config){ratios}, ImageOptions{Width: 640, Ratio: 1.5, HasRatio: true}, 640, 359, 1.78, false},
+		{"ratio allowlist reject", []func(*Config){ratios, reject}, ImageOptions{Width: 640, Ratio: 1.5, HasRatio: true}, 0, 0, 0, true},
+		{"ratio allowlist exact", []func(*Config){ratios, reject}, ImageOptions{Width: 640, Ratio: 1, HasRatio: true}, 640, 640, 1, false},
+	}
+
+	for _, tt := range tests {
+		config := DefaultConfig()
+		for _, configure := range tt.configure {
+			configure(&config)
+		}
+
+		opts := tt.opts
+		err := opts.limitDimensions(config)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %dx%d", tt.name, opts.Width, opts.Height)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if opts.Width != tt.width || opts.Height != tt.height || opts.Ratio != tt.ratio {
+			t.Errorf("%s: got %dx%d ratio %g, want %dx%d ratio %g",
+				tt.name, opts.Width, opts.Height, opts.Ratio, tt.width, tt.height, tt.ratio)
+		}
+	}
+}
+
+func TestSnapEdgeDown(t *testing.T) {
+	tests := []struct {
+		v       int
+		allowed []int
+		step    int
+		want    int
+	}{
+		{500, nil, 0, 500},
+		{500, nil, 80, 480},
+		{50, nil, 80, 50},
+		{500, []int{320, 640}, 0, 320},
+		{100, []int{320, 640}, 0, 320},
+	}
+	for _, tt := range tests {
+		if got := snapEdgeDown(tt.v, tt.allowed, tt.step); got != tt.want {
+			t.Errorf("snapEdgeDown(%d, %v, %d) = %d, want %d", tt.v, tt.allowed, tt.step, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package pluto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+)
+
+// LinkImageResult mirrors UpsertImageResult, the removed files belong to the image
+// the link showed before if no other link refers to it.
+type LinkImageResult struct {
+	HttpStatus        int
+	Message           string
+	FileRemovedFlag   bool
+	CacheFilesRemoved int
+	ImageUuid         string
+}
+
+type linkImageRequest struct {
+	ImageUuid string `json:"image_uuid"`
+}
+
+// API: POST /image/:context/:contextUuid/:identifier/link
+func (pluto *Pluto) linkImageByContext(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "link-pluto-image")
+
+	var body linkImageRequest
+	if err := gc.ShouldBindJSON(&body); err != nil || validateUuid(body.ImageUuid) != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid image_uuid")
+		return
+	}
+
+	context, contextUuid, identifier := gc.Param("context"), gc.Param("contextUuid"), gc.Param("identifier")
+	if _, ok := pluto.authorizeWrite(gc, apiRequest, ActionLink, context, contextUuid, identifier); !ok {
+		return
+	}
+
+	// Only images the user may see can be linked
+	if !pluto.authorizeImage(gc, apiRequest, ActionRead, body.ImageUuid) {
+		return
+	}
+
+	result, err := pluto.LinkImage(gc, body.ImageUuid, context, contextUuid, identifier, nil)
+	if err != nil {
+		writeResultError(apiRequest, result.HttpStatus, result.Message, err)
+		return
+	}
+
+	apiRequest.Success(result.HttpStatus, ImageWriteResponse{
+		ImageUuid:         result.ImageUuid,
+		FileRemoved:       result.FileRemovedFlag,
+		CacheFilesRemoved: result.CacheFilesRemoved,
+	}, result.Message)
+}
+
+// LinkImage attaches an existing image to context/contextId/identifier. The image
+// the link showed before is deleted if no other link refers to it.
+func (pluto *Pluto) LinkImage(
+	gc *gin.Context,
+	imageUuid string,
+	context string,
+	contextUuid string,
+	identifier string,
+	postCallback TxFunc,
+) (LinkImageResult, error) {
+	ctx := gc.Request.Context()
+	dbSchema := pluto.DbSchema
+
+	var result LinkImageResult
+	prevImageUuid := ""
+	var fileNames []string
+
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
+		// Locking the image keeps a concurrent delete of its last link from removing it
+		_, err := pluto.imageLinkCountTx(ctx, tx, imageUuid)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return &ApiTxError{
+					Code: http.StatusNotFound,
+					Err:  errors.New("Image not found"),
+				}
+			}
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to lock pluto image: %v", err),
+			}
+		}
+
+		query := fmt.Sprintf(
+			`SELECT pluto_image_uuid::text
+			 FROM %s.pluto_image_link
+			 WHERE context = $1 AND context_uuid = $2::uuid AND identifier = $3`,
+			dbSchema,
+		)
+		err = tx.QueryRow(ctx, query, context, contextUuid, identifier).Scan(&prevImageUuid)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to get pluto_image_uuid: %v", err),
+			}
+		}
+
+		query = fmt.Sprintf(
+			`INSERT INTO %s.pluto_image_link
+				(pluto_image_uuid, context, context_uuid, identifier)
+			VALUES ($1::uuid, $2, $3::uuid, $4)
+			ON CONFLICT (context, context_uuid, identifier)
+			DO UPDATE SET
+				pluto_image_uuid = EXCLUDED.pluto_image_uuid`,
+			dbSchema)
+		_, err = tx.Exec(ctx, query, imageUuid, context, contextUuid, identifier)
+		if err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Update pluto_image_link failed: %v", err),
+			}
+		}
+
+		// The replaced image goes with its last link
+		if prevImageUuid != "" && prevImageUuid != imageUuid {
+			fileNames, err = pluto.releaseImageTx(ctx, tx, prevImageUuid)
+			if err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Failed to release pluto_image: %v", err),
+				}
+			}
+		}
+
+		// Call the callback inside the transaction
+		if postCallback != nil {
+			if err := postCallback(ctx, tx); err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Post callback function failed: %v", err),
+				}
+			}
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		result.HttpStatus = txErr.Code
+		result.Message = txErr.Err.Error()
+		return result, txErr.Err
+	}
+
+	// Filesystem cleanup (post-commit)
+	if len(fileNames) > 0 {
+		cleanup, err := pluto.CleanupPlutoImageFiles(prevImageUuid, fileNames...)
+		if err == nil {
+			result.CacheFilesRemoved = cleanup.CacheFilesRemoved
+			result.FileRemovedFlag = cleanup.ImageFileRemoved
+		}
+	}
+
+	result.HttpStatus = http.StatusOK
+	result.Message = "image linked successfully"
+	result.ImageUuid = imageUuid
+
+	return result, nil
+}
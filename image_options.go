@@ -0,0 +1,411 @@
+package pluto
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ImageOptions holds the normalized transformation parameters of a getImage request.
+type ImageOptions struct {
+	Type          string // jpg, png, webp, avif or auto
+	Fit           string // cover, contain, fill, inside, outside or empty
+	Background    color.NRGBA
+	HasBackground bool
+	Quality       int
+	Width         int
+	Height        int
+	Ratio         float32
+	HasRatio      bool
+	Lossless      bool
+	Speed         int
+	Dpr           float64 // folded into Width, Height and Quality by ParseImageOptions
+
+	// Requested css pixel dimensions, Query encodes these with the dpr
+	cssWidth  int
+	cssHeight int
+}
+
+// defaultImageQuality is used if the request has no quality parameter
+const defaultImageQuality = 80
+
+// allowedDprs are the supported device pixel ratios, each one multiplies the variants
+// of an image, presets included
+var allowedDprs = []float64{1, 1.5, 2, 3}
+
+// fitCodes maps the supported fit modes (like CSS object-fit) to their code in the cache receipt
+var fitCodes = map[string]int{
+	"cover":   0x01,
+	"contain": 0x02,
+	"fill":    0x03,
+	"inside":  0x04,
+	"outside": 0x05,
+}
+
+// DefaultImageOptions returns the options getImage uses for parameters not given in the request.
+func (pluto *Pluto) DefaultImageOptions() ImageOptions {
+	return ImageOptions{
+		Type:    pluto.Config.PlutoDefaultImageType,
+		Quality: defaultImageQuality,
+		Speed:   pluto.Config.PlutoAvifSpeed,
+		Dpr:     1,
+	}
+}
+
+// ParseImageOptions parses and normalizes the transformation query parameters of getImage.
+func (pluto *Pluto) ParseImageOptions(query url.Values) (ImageOptions, error) {
+	opts := pluto.DefaultImageOptions()
+
+	opts.Type = queryDefault(query, "type", opts.Type)
+	if !isImageType(opts.Type) && opts.Type != "auto" {
+		return opts, errors.New("invalid type parameter, must be one of 'jpg', 'png', 'webp', 'avif' or 'auto'")
+	}
+
+	opts.Fit = queryDefault(query, "fit", "")
+	if _, ok := fitCodes[opts.Fit]; opts.Fit != "" && !ok {
+		return opts, errors.New("invalid fit parameter, must be one of 'cover', 'contain', 'fill', 'inside' or 'outside'")
+	}
+
+	if backgroundStr, ok := queryValue(query, "background"); ok {
+		var err error
+		opts.Background, err = ParseHexColor(backgroundStr)
+		if err != nil {
+			return opts, errors.New("invalid background parameter")
+		}
+		opts.HasBackground = true
+	}
+
+	quality, ok := queryIntDefault(query, "quality", opts.Quality)
+	if !ok {
+		return opts, errors.New("invalid quality parameter")
+	}
+	opts.Quality = clampInt(quality, 0, 100)
+
+	opts.Width, ok = queryIntDefault(query, "width", 0)
+	if !ok {
+		return opts, errors.New("invalid width parameter")
+	}
+
+	opts.Height, ok = queryIntDefault(query, "height", 0)
+	if !ok {
+		return opts, errors.New("invalid height parameter")
+	}
+
+	if ratioStr, hasRatio := queryValue(query, "ratio"); hasRatio {
+		ratio, err := ParseAspectRatio(ratioStr)
+		if err != nil {
+			return opts, errors.New("invalid ratio parameter")
+		}
+		opts.Ratio = ratio
+		opts.HasRatio = true
+	}
+
+	opts.Lossless, ok = queryBoolDefault(query, "lossless", false)
+	if !ok {
+		return opts, errors.New("invalid lossless parameter")
+	}
+
+	// AVIF encoder speed, 1 (slowest, smallest) - 10 (fastest)
+	opts.Speed, ok = queryIntDefault(query, "speed", opts.Speed)
+	if !ok || opts.Speed < 1 || opts.Speed > 10 {
+		return opts, errors.New("invalid speed parameter")
+	}
+
+	// limitDimensions derives the missing edge from the ratio
+	if opts.HasRatio && opts.Ratio <= 0.0001 {
+		return opts, errors.New("invalid ratio format")
+	}
+
+	opts.Dpr, ok = queryFloatDefault(query, "dpr", 1)
+	if !ok || !slices.Contains(allowedDprs, opts.Dpr) {
+		return opts, errors.New("invalid dpr parameter, must be one of 1, 1.5, 2 or 3")
+	}
+	if opts.Dpr != 1 {
+		opts.cssWidth = opts.Width
+		opts.cssHeight = opts.Height
+		opts.Width = int(math.Round(float64(opts.Width) * opts.Dpr))
+		opts.Height = int(math.Round(float64(opts.Height) * opts.Dpr))
+		if !query.Has("quality") {
+			opts.Quality = qualityForDpr(opts.Quality, opts.Dpr)
+		}
+	}
+
+	if err := opts.limitDimensions(pluto.Config); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// Query encodes the options as explicit query parameters, ParseImageOptions
+// turns them back into the same options. Parsed options with a dpr keep the
+// requested dimensions, so the dpr is part of signatures.
+func (opts ImageOptions) Query() url.Values {
+	width, height := opts.Width, opts.Height
+	if opts.Dpr > 0 && opts.Dpr != 1 && (opts.cssWidth > 0 || opts.cssHeight > 0) {
+		width, height = opts.cssWidth, opts.cssHeight
+	}
+
+	query := url.Values{}
+	query.Set("type", opts.Type)
+	if opts.Fit != "" {
+		query.Set("fit", opts.Fit)
+	}
+	if opts.HasBackground {
+		bg := opts.Background
+		query.Set("background", fmt.Sprintf("%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A))
+	}
+	// ParseImageOptions lowers a missing quality with the dpr
+	dpr := opts.Dpr
+	if dpr <= 0 {
+		dpr = 1
+	}
+	if opts.Quality != qualityForDpr(defaultImageQuality, dpr) {
+		query.Set("quality", strconv.Itoa(opts.Quality))
+	}
+	if width > 0 {
+		query.Set("width", strconv.Itoa(width))
+	}
+	if height > 0 {
+		query.Set("height", strconv.Itoa(height))
+	}
+	if opts.HasRatio {
+		query.Set("ratio", strconv.FormatFloat(float64(opts.Ratio), 'g', -1, 32)+":1")
+	}
+	if opts.Lossless {
+		query.Set("lossless", "true")
+	}
+	if opts.Type == "avif" || opts.Type == "auto" {
+		query.Set("speed", strconv.Itoa(opts.Speed))
+	}
+	if opts.Dpr > 0 && opts.Dpr != 1 {
+		query.Set("dpr", strconv.FormatFloat(opts.Dpr, 'g', -1, 64))
+	}
+	return query
+}
+
+// qualityForDpr lowers the default quality for high density displays, where
+// compression artifacts are much less visible.
+func qualityForDpr(quality int, dpr float64) int {
+	switch {
+	case dpr >= 2.5:
+		quality -= 25
+	case dpr >= 1.5:
+		quality -= 15
+	}
+	return max(quality, 30)
+}
+
+// Resizes reports whether the options change the dimensions of the image.
+func (opts ImageOptions) Resizes() bool {
+	return opts.Width > 0 || opts.Height > 0 || opts.HasRatio
+}
+
+// EffectiveBackground returns the padding color for fit=contain. Without an explicit
+// background JPEG is padded white, all other types transparent.
+func (opts ImageOptions) EffectiveBackground() color.NRGBA {
+	if opts.HasBackground {
+		return opts.Background
+	}
+	if opts.Type == "jpg" {
+		return color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	}
+	return color.NRGBA{}
+}
+
+// Receipt encodes the options as cache receipt: uuid_paramCode_paramValues
+func (opts ImageOptions) Receipt(imageUuid string) string {
+	var paramCode, paramValues string
+	if opts.Fit != "" {
+		paramCode += "f"
+		paramValues += fmt.Sprintf("%02x", fitCodes[opts.Fit])
+	}
+	if opts.Fit == "contain" {
+		bg := opts.EffectiveBackground()
+		paramCode += "b"
+		paramValues += fmt.Sprintf("%02x%02x%02x%02x", bg.R, bg.G, bg.B, bg.A)
+	}
+	if opts.Quality < 100 {
+		paramCode += "q"
+		paramValues += fmt.Sprintf("%02x", opts.Quality) // 0 - 99
+	}
+	if opts.Width > 0 {
+		paramCode += "w"
+		paramValues += fmt.Sprintf("%04x", opts.Width) // max 65535 pixel
+	}
+	if opts.Height > 0 {
+		paramCode += "h"
+		paramValues += fmt.Sprintf("%04x", opts.Height) // max 65535 pixel
+	}
+	if opts.Type == "avif" {
+		paramCode += "s"
+		paramValues += fmt.Sprintf("%02x", opts.Speed)
+	}
+	if opts.Lossless && (opts.Type == "webp" || opts.Type == "avif") {
+		paramCode += "l"
+		paramValues += "01"
+	}
+	if opts.HasRatio {
+		paramCode += "r"
+		paramValues += "_" + EncodeFloat32ForPath(opts.Ratio)
+	}
+
+	return fmt.Sprintf("%s_%s_%s", imageUuid, paramCode, paramValues)
+}
+
+// CacheFileName returns the name of the cache file, the receipt with the file type as extension
+func (opts ImageOptions) CacheFileName(imageUuid string) string {
+	return opts.Receipt(imageUuid) + "." + opts.Type
+}
+
+// NegotiateImageType picks the output type for type=auto from the Accept header.
+// AVIF and WebP are only chosen if listed explicitly, clients unable to decode them
+// send wildcards like image/* too. Other clients get JPEG for opaque sources and PNG
+// for sources with transparency, unless they accept only the other one.
+func NegotiateImageType(accept string, opaque bool) string {
+	if acceptsMimeType(accept, "image/avif") {
+		return "avif"
+	}
+	if acceptsMimeType(accept, "image/webp") {
+		return "webp"
+	}
+
+	preferred, other := "png", "jpg"
+	if opaque {
+		preferred, other = "jpg", "png"
+	}
+	if acceptsMimeRange(accept, imageTypeMimeType(preferred)) || !acceptsMimeRange(accept, imageTypeMimeType(other)) {
+		return preferred
+	}
+	return other
+}
+
+// acceptsMimeType reports whether the Accept header lists a mime type explicitly
+func acceptsMimeType(accept string, mimeType string) bool {
+	return acceptQuality(accept, mimeType, false) > 0
+}
+
+// acceptsMimeRange reports whether the Accept header allows a mime type, wildcards
+// included. Without Accept header everything is allowed.
+func acceptsMimeRange(accept string, mimeType string) bool {
+	return acceptQuality(accept, mimeType, true) > 0
+}
+
+// acceptQuality returns the quality the Accept header assigns to a mime type, the
+// most specific matching range wins. Explicit rejection like "image/avif;q=0" returns 0.
+func acceptQuality(accept string, mimeType string, wildcards bool) float64 {
+	if strings.TrimSpace(accept) == "" {
+		if wildcards {
+			return 1
+		}
+		return 0
+	}
+
+	mainType, _, _ := strings.Cut(mimeType, "/")
+	quality, bestSpecificity := 0.0, 0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		specificity := 0
+		switch {
+		case mediaRange == mimeType:
+			specificity = 3
+		case wildcards && mediaRange == mainType+"/*":
+			specificity = 2
+		case wildcards && mediaRange == "*/*":
+			specificity = 1
+		default:
+			continue
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		quality, bestSpecificity = q, specificity
+	}
+
+	return quality
+}
+
+// imageTypeMimeType returns the MIME type of an output type, image/jpeg for jpg
+func imageTypeMimeType(fileType string) string {
+	if fileType == "jpg" {
+		return "image/jpeg"
+	}
+	return "image/" + fileType
+}
+
+func isImageType(fileType string) bool {
+	switch fileType {
+	case "jpg", "png", "webp", "avif":
+		return true
+	}
+	return false
+}
+
+func queryValue(query url.Values, key string) (string, bool) {
+	if values, ok := query[key]; ok && len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+func queryDefault(query url.Values, key string, def string) string {
+	if str, ok := queryValue(query, key); ok {
+		return str
+	}
+	return def
+}
+
+func queryIntDefault(query url.Values, key string, def int) (int, bool) {
+	str, ok := queryValue(query, key)
+	if !ok {
+		return def, true
+	}
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+func queryFloatDefault(query url.Values, key string, def float64) (float64, bool) {
+	str, ok := queryValue(query, key)
+	if !ok {
+		return def, true
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+func queryBoolDefault(query url.Values, key string, def bool) (bool, bool) {
+	str, ok := queryValue(query, key)
+	if !ok {
+		return def, true
+	}
+	if str == "" {
+		return true, true
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, false
+	}
+	return val, true
+}
@@ -0,0 +1,226 @@
+package pluto
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestPluto() *Pluto {
+	return &Pluto{Config: DefaultConfig()}
+}
+
+// TestImageOptionsRoundTrip checks that Query encodes parsed options so that
+// ParseImageOptions returns the same options, signatures depend on it.
+func TestImageOptionsRoundTrip(t *testing.T) {
+	configs := map[string]func(*Config){
+		"default": func(*Config) {},
+		"step":    func(c *Config) { c.PlutoDimensionStep = 80 },
+		"allowlist": func(c *Config) {
+			c.PlutoAllowedWidths = []int{320, 640, 1280}
+			c.PlutoAllowedRatios = []string{"1:1", "16:9"}
+		},
+	}
+
+	params := [][]string{
+		{"", "type=jpg", "type=webp", "type=avif", "type=auto"},
+		{"", "fit=cover", "fit=contain", "fit=contain&background=ff000080"},
+		{"", "quality=0", "quality=55", "quality=65", "quality=80", "quality=100"},
+		{"", "width=320", "width=333", "width=5000"},
+		{"", "height=200", "height=201"},
+		{"", "ratio=16:9", "ratio=3:2"},
+		{"", "dpr=1", "dpr=1.5", "dpr=2", "dpr=3"},
+	}
+
+	for name, configure := range configs {
+		pluto := newTestPluto()
+		configure(&pluto.Config)
+
+		for _, q := range combineParams(params) {
+			query, _ := url.ParseQuery(q)
+			opts, err := pluto.ParseImageOptions(query)
+			if err != nil {
+				continue
+			}
+			again, err := pluto.ParseImageOptions(opts.Query())
+			if err != nil {
+				t.Errorf("%s %q: reparse of %q failed: %v", name, q, opts.Query().Encode(), err)
+				continue
+			}
+			if again.Query().Encode() != opts.Query().Encode() || again.Receipt("x") != opts.Receipt("x") {
+				t.Errorf("%s %q: %q reparsed as %q", name, q, opts.Query().Encode(), again.Query().Encode())
+			}
+		}
+	}
+}
+
+func combineParams(params [][]string) []string {
+	result := []string{""}
+	for _, values := range params {
+		var next []string
+		for _, prefix := range result {
+			for _, value := range values {
+				next = append(next, strings.Trim(prefix+"&"+value, "&"))
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+func TestSignedURLKeepsQuality(t *testing.T) {
+	pluto := newTestPluto()
+	pluto.Config.PlutoSignatureSecret = "secret"
+
+	tests := []struct {
+		quality int
+		want    string
+	}{
+		{80, "quality=80"},
+		{65, ""},
+		{50, "quality=50"},
+	}
+	for _, tt := range tests {
+		opts := pluto.DefaultImageOptions()
+		opts.Width = 320
+		opts.Dpr = 2
+		opts.Quality = tt.quality
+
+		signedURL, err := pluto.SignedURL("uuid", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, _ := url.Parse(signedURL)
+		query := parsed.Query()
+		parsedOpts, err := pluto.ParseImageOptions(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedOpts.Quality != tt.quality {
+			t.Errorf("quality %d: %s parses as quality %d", tt.quality, signedURL, parsedOpts.Quality)
+		}
+		if tt.want != "" && !strings.Contains(signedURL, tt.want) {
+			t.Errorf("quality %d: %s lacks %s", tt.quality, signedURL, tt.want)
+		}
+		if !pluto.verifyImageSignature("uuid", parsedOpts, query.Get("sig")) {
+			t.Errorf("quality %d: signature of %s does not verify", tt.quality, signedURL)
+		}
+	}
+}
+
+func TestParseImageOptionsDpr(t *testing.T) {
+	pluto := newTestPluto()
+
+	tests := []struct {
+		query   string
+		width   int
+		quality int
+		wantErr bool
+	}{
+		{"width=320", 320, 80, false},
+		{"width=320&dpr=1.5", 480, 65, false},
+		{"width=320&dpr=2", 640, 65, false},
+		{"width=320&dpr=3", 960, 55, false},
+		{"width=320&dpr=2&quality=90", 640, 90, false},
+		{"width=320&dpr=2.5", 0, 0, true},
+		{"width=320&dpr=0", 0, 0, true},
+		{"width=320&dpr=x", 0, 0, true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		opts, err := pluto.ParseImageOptions(query)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if opts.Width != tt.width || opts.Quality != tt.quality {
+			t.Errorf("%q: got width %d quality %d, want %d %d", tt.query, opts.Width, opts.Quality, tt.width, tt.quality)
+		}
+	}
+}
+
+func TestNegotiateImageType(t *testing.T) {
+	chrome := "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	tests := []struct {
+		accept string
+		opaque bool
+		want   string
+	}{
+		{chrome, true, "avif"},
+		{"image/webp,*/*", true, "webp"},
+		{"image/avif;q=0,image/webp", true, "webp"},
+		{"image/avif;q=0,image/webp;q=0,image/*", true, "jpg"},
+		{"", true, "jpg"},
+		{"", false, "png"},
+		{"image/*", true, "jpg"},
+		{"image/*", false, "png"},
+		{"*/*", false, "png"},
+		{"image/png", true, "png"},
+		{"image/jpeg", false, "jpg"},
+		{"image/*,image/png;q=0", false, "jpg"},
+		{"text/html", true, "jpg"},
+	}
+	for _, tt := range tests {
+		if got := NegotiateImageType(tt.accept, tt.opaque); got != tt.want {
+			t.Errorf("NegotiateImageType(%q, %t) = %s, want %s", tt.accept, tt.opaque, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mimeType  string
+		wildcards bool
+		want      float64
+	}{
+		{"", "image/webp", true, 1},
+		{"", "image/webp", false, 0},
+		{"image/webp", "image/webp", false, 1},
+		{"IMAGE/WEBP;q=0.5", "image/webp", false, 0.5},
+		{"image/*", "image/webp", false, 0},
+		{"image/*;q=0.7", "image/webp", true, 0.7},
+		{"*/*;q=0.3", "image/webp", true, 0.3},
+		{"*/*;q=0.3,image/*;q=0.6", "image/webp", true, 0.6},
+		{"image/*,image/webp;q=0", "image/webp", true, 0},
+		{"image/webp;q=0,*/*", "image/webp", true, 0},
+		{"text/html", "image/webp", true, 0},
+	}
+	for _, tt := range tests {
+		if got := acceptQuality(tt.accept, tt.mimeType, tt.wildcards); got != tt.want {
+			t.Errorf("acceptQuality(%q, %s, %t) = %g, want %g", tt.accept, tt.mimeType, tt.wildcards, got, tt.want)
+		}
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	pluto := newTestPluto()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"type=jpg", "u_q_50"},
+		{"type=jpg&quality=100", "u__"},
+		{"type=png&width=320&height=200", "u_qwh_50014000c8"},
+		{"type=jpg&fit=contain&quality=90", "u_fbq_02ffffffff5a"},
+		{"type=webp&fit=contain&lossless=true&quality=100", "u_fbl_020000000001"},
+		{"type=avif&speed=6&quality=100", "u_s_06"},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		opts, err := pluto.ParseImageOptions(query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := opts.Receipt("u"); got != tt.want {
+			t.Errorf("%q: receipt %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
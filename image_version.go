@@ -0,0 +1,348 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sndcds/grains/grains_api"
+)
+
+// ImageVersion is a replaced master kept in pluto_image_version
+type ImageVersion struct {
+	Id         int        `json:"id"`
+	Version    int        `json:"version"`
+	FileName   *string    `json:"file_name,omitempty"`
+	Width      *int       `json:"width,omitempty"`
+	Height     *int       `json:"height,omitempty"`
+	MimeType   *string    `json:"mime_type,omitempty"`
+	CreatedBy  *string    `json:"created_by,omitempty"` // uploader of this version
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ReplacedBy *string    `json:"replaced_by,omitempty"`
+	ReplacedAt time.Time  `json:"replaced_at"`
+}
+
+// RestoreImageVersionResult mirrors UpsertImageResult
+type RestoreImageVersionResult struct {
+	HttpStatus        int
+	Message           string
+	FileRemovedFlag   bool
+	CacheFilesRemoved int
+	ImageUuid         string
+}
+
+// imageVersionColumns are copied between pluto_image and pluto_image_version
+const imageVersionColumns = `file_name, gen_file_name, width, height, mime_type, exif,
+	original_gen_file_name, original_checksum, original_size, original_mime_type, phash`
+
+// API: GET /image/versions/:uuid
+func (pluto *Pluto) getImageVersions(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "get-pluto-image-versions")
+
+	imageUuid := gc.Param("uuid")
+	if validateUuid(imageUuid) != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	if !pluto.authorizeImage(gc, apiRequest, ActionMeta, imageUuid) {
+		return
+	}
+
+	versions, err := pluto.ImageVersions(gc.Request.Context(), imageUuid)
+	if err != nil {
+		apiRequest.DatabaseError()
+		return
+	}
+
+	apiRequest.Success(http.StatusOK, versions, "")
+}
+
+// API: POST /image/:context/:contextUuid/:identifier/versions/:versionId/restore
+func (pluto *Pluto) restoreImageVersion(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "restore-pluto-image-version")
+
+	versionId, err := strconv.Atoi(gc.Param("versionId"))
+	if err != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid versionId")
+		return
+	}
+
+	// Restoring replaces the master like an upload into the link
+	context, contextUuid, identifier := gc.Param("context"), gc.Param("contextUuid"), gc.Param("identifier")
+	userUuid, ok := pluto.authorizeWrite(gc, apiRequest, ActionUpload, context, contextUuid, identifier)
+	if !ok {
+		return
+	}
+
+	imageUuid, ok := pluto.GetImageUuidByByContext(gc, context, contextUuid, identifier)
+	if !ok {
+		apiRequest.DatabaseError()
+		return
+	}
+	if imageUuid == "" {
+		apiRequest.Error(http.StatusNotFound, "image not found")
+		return
+	}
+
+	result, err := pluto.RestoreImageVersion(gc.Request.Context(), imageUuid, versionId, userUuid)
+	if err != nil {
+		writeResultError(apiRequest, result.HttpStatus, result.Message, err)
+		return
+	}
+
+	apiRequest.Success(result.HttpStatus, ImageWriteResponse{
+		ImageUuid:         result.ImageUuid,
+		FileRemoved:       result.FileRemovedFlag,
+		CacheFilesRemoved: result.CacheFilesRemoved,
+	}, result.Message)
+}
+
+// ImageVersions returns the replaced masters of an image, the latest replaced first
+func (pluto *Pluto) ImageVersions(ctx context.Context, imageUuid string) ([]ImageVersion, error) {
+	query := fmt.Sprintf(
+		`SELECT id, version, file_name, width, height, mime_type,
+			created_by::text, created_at, replaced_by::text, replaced_at
+		 FROM %s.pluto_image_version
+		 WHERE pluto_image_uuid = $1::uuid
+		 ORDER BY replaced_at DESC, id DESC`,
+		pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query, imageUuid)
+	if err != nil {
+		return nil, fmt.Errorf("Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []ImageVersion{}
+	for rows.Next() {
+		var v ImageVersion
+		err := rows.Scan(&v.Id, &v.Version, &v.FileName, &v.Width, &v.Height, &v.MimeType,
+			&v.CreatedBy, &v.CreatedAt, &v.ReplacedBy, &v.ReplacedAt)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// RestoreImageVersion makes a replaced master current again. The current master
+// moves into the history, the cache of the image is purged. Images shared by
+// several links are not restored, the other links would change with them.
+func (pluto *Pluto) RestoreImageVersion(
+	ctx context.Context,
+	imageUuid string,
+	versionId int,
+	userUuid string,
+) (RestoreImageVersionResult, error) {
+	dbSchema := pluto.DbSchema
+
+	var result RestoreImageVersionResult
+	var prunedFileNames []string
+
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
+		// Serializes restores, uploads and links of the image
+		linkCount, err := pluto.imageLinkCountTx(ctx, tx, imageUuid)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return &ApiTxError{
+					Code: http.StatusNotFound,
+					Err:  errors.New("Image not found"),
+				}
+			}
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to lock pluto image: %v", err),
+			}
+		}
+		if linkCount > 1 {
+			return &ApiTxError{
+				Code: http.StatusConflict,
+				Err:  errors.New("Image is shared by other links and can't be restored"),
+			}
+		}
+
+		query := fmt.Sprintf(
+			`SELECT 1 FROM %s.pluto_image_version WHERE id = $1 AND pluto_image_uuid = $2::uuid`,
+			dbSchema)
+		var found int
+		err = tx.QueryRow(ctx, query, versionId, imageUuid).Scan(&found)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return &ApiTxError{
+					Code: http.StatusNotFound,
+					Err:  errors.New("Version not found"),
+				}
+			}
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to get pluto_image_version: %v", err),
+			}
+		}
+
+		if err := pluto.archiveImageVersionTx(ctx, tx, imageUuid, userUuid); err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to archive pluto image: %v", err),
+			}
+		}
+
+		query = fmt.Sprintf(
+			`UPDATE %s.pluto_image SET (%s, version, uploaded_by, uploaded_at) =
+				(SELECT %s, version, created_by, created_at FROM %s.pluto_image_version WHERE id = $1)
+			 WHERE uuid = $2::uuid`,
+			dbSchema, imageVersionColumns, imageVersionColumns, dbSchema)
+		if _, err := tx.Exec(ctx, query, versionId, imageUuid); err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to restore pluto image: %v", err),
+			}
+		}
+
+		query = fmt.Sprintf(`DELETE FROM %s.pluto_image_version WHERE id = $1`, dbSchema)
+		if _, err := tx.Exec(ctx, query, versionId); err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to delete pluto_image_version: %v", err),
+			}
+		}
+
+		prunedFileNames, err = pluto.pruneImageVersionsTx(ctx, tx, imageUuid)
+		if err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to prune image versions: %v", err),
+			}
+		}
+
+		if _, err := pluto.DeleteCacheTx(ctx, tx, imageUuid); err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to delete cached files: %v", err),
+			}
+		}
+
+		return nil
+	})
+	if txErr != nil {
+		result.HttpStatus = txErr.Code
+		result.Message = txErr.Err.Error()
+		return result, txErr.Err
+	}
+
+	// Filesystem cleanup (post-commit)
+	cleanup, err := pluto.CleanupPlutoImageFiles(imageUuid, prunedFileNames...)
+	if err == nil {
+		result.CacheFilesRemoved = cleanup.CacheFilesRemoved
+		result.FileRemovedFlag = cleanup.ImageFileRemoved
+	}
+
+	result.HttpStatus = http.StatusOK
+	result.Message = "image version restored successfully"
+	result.ImageUuid = imageUuid
+
+	return result, nil
+}
+
+// PruneImageVersions deletes the versions of all images beyond pluto_versions_keep
+// and pluto_versions_max_age with their files, it returns the number of deleted versions.
+// With pluto_versions_keep 0 the whole history is deleted.
+func (pluto *Pluto) PruneImageVersions(ctx context.Context) (int, error) {
+	var fileNames []string
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
+		var err error
+		fileNames, err = pluto.pruneImageVersionsTx(ctx, tx, "")
+		if err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to prune image versions: %w", err),
+			}
+		}
+		return nil
+	})
+	if txErr != nil {
+		return 0, txErr.Err
+	}
+
+	for _, fileName := range fileNames {
+		if fileName == "" {
+			continue
+		}
+		if err := pluto.ImageStorage.Delete(ctx, fileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return 0, fmt.Errorf("Failed to delete file %s: %w", fileName, err)
+		}
+	}
+
+	// Masters and originals come in pairs
+	return len(fileNames) / 2, nil
+}
+
+// archiveImageVersionTx copies the current master of an image into the history
+func (pluto *Pluto) archiveImageVersionTx(ctx context.Context, tx pgx.Tx, imageUuid string, userUuid string) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s.pluto_image_version
+			(pluto_image_uuid, version, %s, created_by, created_at, replaced_by)
+		 SELECT uuid, version, %s, uploaded_by, uploaded_at, NULLIF($2, '')::uuid
+		 FROM %s.pluto_image
+		 WHERE uuid = $1::uuid AND gen_file_name IS NOT NULL`,
+		pluto.DbSchema, imageVersionColumns, imageVersionColumns, pluto.DbSchema)
+	_, err := tx.Exec(ctx, query, imageUuid, userUuid)
+	return err
+}
+
+// nextImageVersionTx locks an image and returns the version number for its new master
+func (pluto *Pluto) nextImageVersionTx(ctx context.Context, tx pgx.Tx, imageUuid string) (int, error) {
+	if err := pluto.lockImageTx(ctx, tx, imageUuid); err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(
+		`SELECT GREATEST(i.version, COALESCE(MAX(v.version), 0)) + 1
+		 FROM %s.pluto_image i
+		 LEFT JOIN %s.pluto_image_version v ON v.pluto_image_uuid = i.uuid
+		 WHERE i.uuid = $1::uuid
+		 GROUP BY i.version`,
+		pluto.DbSchema, pluto.DbSchema)
+	var version int
+	err := tx.QueryRow(ctx, query, imageUuid).Scan(&version)
+	return version, err
+}
+
+// pruneImageVersionsTx deletes the versions beyond the configured retention, of all
+// images if imageUuid is empty. It returns their files to delete after the commit.
+func (pluto *Pluto) pruneImageVersionsTx(ctx context.Context, tx pgx.Tx, imageUuid string) ([]string, error) {
+	query := fmt.Sprintf(
+		`DELETE FROM %s.pluto_image_version WHERE id IN (
+			SELECT id FROM (
+				SELECT id, replaced_at,
+					row_number() OVER (PARTITION BY pluto_image_uuid ORDER BY replaced_at DESC, id DESC) AS n
+				FROM %s.pluto_image_version
+				WHERE $1 = '' OR pluto_image_uuid::text = lower($1)
+			) ranked
+			WHERE n > $2::int OR ($3::int > 0 AND replaced_at < now() - make_interval(days => $3::int)))
+		 RETURNING gen_file_name, COALESCE(original_gen_file_name, '')`,
+		pluto.DbSchema, pluto.DbSchema)
+	rows, err := tx.Query(ctx, query, imageUuid, pluto.Config.PlutoVersionsKeep, pluto.Config.PlutoVersionsMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fileNames []string
+	for rows.Next() {
+		var genFileName, originalGenFileName string
+		if err := rows.Scan(&genFileName, &originalGenFileName); err != nil {
+			return nil, err
+		}
+		fileNames = append(fileNames, genFileName, originalGenFileName)
+	}
+
+	return fileNames, rows.Err()
+}
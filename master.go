@@ -0,0 +1,89 @@
+package pluto
+
+import (
+	"bytes"
+	"errors"
+	"image"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/avif"
+)
+
+var (
+	errInvalidImage      = errors.New("Invalid image")
+	errUnsupportedFormat = errors.New("Unsupported image format")
+)
+
+// masterImage is the normalized master derived from an uploaded original
+type masterImage struct {
+	Data     []byte
+	MimeType string
+	FileExt  string
+	Width    int
+	Height   int
+	PHash    uint64 // see DHash
+}
+
+// normalizeImage decodes an original, downscales it to fit maxWidth x maxHeight and
+// encodes it in the format of the original with the given quality.
+func (pluto *Pluto) normalizeImage(original []byte, mimeType string, maxWidth int, maxHeight int, quality int) (*masterImage, error) {
+	img, err := decodeImage(original, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downscale if needed
+	if img.Bounds().Dx() > maxWidth || img.Bounds().Dy() > maxHeight {
+		img = imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
+	}
+
+	buf := new(bytes.Buffer)
+	master := masterImage{MimeType: mimeType, Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), PHash: DHash(img)}
+	switch mimeType {
+	case "image/png":
+		err = imaging.Encode(buf, img, imaging.PNG)
+		master.FileExt = ".png"
+	case "image/jpeg":
+		err = imaging.Encode(buf, img, imaging.JPEG, imaging.JPEGQuality(quality))
+		master.FileExt = ".jpg"
+	case "image/webp":
+		err = webp.Encode(buf, img, &webp.Options{
+			Quality: float32(quality),
+		})
+		master.FileExt = ".webp"
+	case "image/avif":
+		err = avif.Encode(buf, img, avif.Options{
+			Quality:      quality,
+			QualityAlpha: quality,
+			Speed:        pluto.Config.PlutoAvifSpeed,
+		})
+		master.FileExt = ".avif"
+	default:
+		return nil, errUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	master.Data = buf.Bytes()
+	return &master, nil
+}
+
+// decodeImage decodes an uploaded image, formats missing in the image package by mime type
+func decodeImage(data []byte, mimeType string) (image.Image, error) {
+	var img image.Image
+	var err error
+	switch mimeType {
+	case "image/avif":
+		img, err = avif.Decode(bytes.NewReader(data))
+	case "image/webp":
+		img, err = webp.Decode(bytes.NewReader(data))
+	default:
+		img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	return img, nil
+}
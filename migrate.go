@@ -0,0 +1,181 @@
+package pluto
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change, {{schema}} in Sql is replaced by Config.DbSchema
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+// ErrSchemaVersionMismatch is returned if the database schema is not at LatestSchemaVersion
+var ErrSchemaVersionMismatch = errors.New("database schema version mismatch")
+
+// Migrations returns the embedded migrations ordered by version. File names
+// follow the pattern 0001_name.sql.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		versionStr, rest, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", name)
+		}
+
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: rest, Sql: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be consecutive, missing version %d", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version of the newest embedded migration
+func LatestSchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the database schema, 0 if pluto tables were never migrated
+func (pluto *Pluto) SchemaVersion(ctx context.Context) (int, error) {
+	return schemaVersion(ctx, pluto.DbPool, pluto.DbSchema)
+}
+
+// Migrate applies all pending migrations in a single transaction. Concurrent
+// calls, e.g. from several replicas starting at once, are serialized.
+func (pluto *Pluto) Migrate(ctx context.Context) error {
+	if pluto.DbSchema == "" {
+		return errors.New("db_schema is required for migrations")
+	}
+
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	tx, err := pluto.DbPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, pluto.DbSchema+".pluto_schema_version")
+	if err != nil {
+		return fmt.Errorf("Failed to lock migrations: %w", err)
+	}
+
+	sql := fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS %s;
+		CREATE TABLE IF NOT EXISTS %s.pluto_schema_version (
+			version    integer PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`,
+		pluto.DbSchema, pluto.DbSchema)
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("Failed to create pluto_schema_version: %w", err)
+	}
+
+	current, err := schemaVersion(ctx, tx, pluto.DbSchema)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("%w: database is at version %d, pluto supports %d", ErrSchemaVersionMismatch, current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		pluto.Log(fmt.Sprintf("migrate to version %d (%s)", m.Version, m.Name))
+
+		if _, err := tx.Exec(ctx, strings.ReplaceAll(m.Sql, "{{schema}}", pluto.DbSchema)); err != nil {
+			return fmt.Errorf("Migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+
+		sql := fmt.Sprintf(`INSERT INTO %s.pluto_schema_version (version, name) VALUES ($1, $2)`, pluto.DbSchema)
+		if _, err := tx.Exec(ctx, sql, m.Version, m.Name); err != nil {
+			return fmt.Errorf("Failed to record migration %d: %w", m.Version, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Failed to commit migrations: %w", err)
+	}
+
+	return nil
+}
+
+// CheckSchema returns ErrSchemaVersionMismatch if the database schema is not at LatestSchemaVersion
+func (pluto *Pluto) CheckSchema(ctx context.Context) error {
+	current, err := pluto.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); current != latest {
+		return fmt.Errorf("%w: database is at version %d, pluto requires %d", ErrSchemaVersionMismatch, current, latest)
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func schemaVersion(ctx context.Context, db queryRower, schema string) (int, error) {
+	var exists bool
+	err := db.QueryRow(ctx,
+		`SELECT to_regclass($1) IS NOT NULL`, schema+".pluto_schema_version").Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to check pluto_schema_version: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	query := fmt.Sprintf(`SELECT COALESCE(MAX(version), 0) FROM %s.pluto_schema_version`, schema)
+	if err := db.QueryRow(ctx, query).Scan(&version); err != nil {
+		return 0, fmt.Errorf("Failed to read schema version: %w", err)
+	}
+	return version, nil
+}
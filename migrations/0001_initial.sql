@@ -0,0 +1,70 @@
+-- Images, their links to application entities, rendered cache files and
+-- per context upload rules.
+
+CREATE SCHEMA IF NOT EXISTS {{schema}};
+
+CREATE TABLE IF NOT EXISTS {{schema}}.pluto_image (
+    uuid            uuid PRIMARY KEY,
+    file_name       text,
+    gen_file_name   text,
+    width           integer,
+    height          integer,
+    mime_type       text,
+    exif            jsonb,
+    alt_text        text,
+    description     text,
+    license         text,
+    expiration_date date,
+    creator_name    text,
+    copyright       text,
+    focus_x         double precision,
+    focus_y         double precision,
+    created_by      uuid,
+    created_at      timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS {{schema}}.pluto_image_link (
+    id               serial PRIMARY KEY,
+    pluto_image_uuid uuid NOT NULL REFERENCES {{schema}}.pluto_image (uuid) ON DELETE CASCADE,
+    context          text NOT NULL,
+    context_uuid     uuid NOT NULL,
+    identifier       text NOT NULL
+);
+
+-- Tables created before the migrations may lack the unique constraints, the
+-- indexes are named like the constraints PostgreSQL would have created
+CREATE UNIQUE INDEX IF NOT EXISTS pluto_image_link_context_context_uuid_identifier_key
+    ON {{schema}}.pluto_image_link (context, context_uuid, identifier);
+
+CREATE INDEX IF NOT EXISTS pluto_image_link_image_idx ON {{schema}}.pluto_image_link (pluto_image_uuid);
+
+CREATE TABLE IF NOT EXISTS {{schema}}.pluto_cache (
+    id               serial PRIMARY KEY,
+    receipt          text NOT NULL,
+    pluto_image_uuid uuid NOT NULL REFERENCES {{schema}}.pluto_image (uuid) ON DELETE CASCADE,
+    mime_type        text NOT NULL,
+    created_at       timestamptz NOT NULL DEFAULT now()
+);
+
+-- Duplicate rows written before the constraint existed would fail the index
+DELETE FROM {{schema}}.pluto_cache a
+    USING {{schema}}.pluto_cache b
+    WHERE a.receipt = b.receipt AND a.mime_type = b.mime_type AND a.id > b.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS pluto_cache_receipt_mime_type_key
+    ON {{schema}}.pluto_cache (receipt, mime_type);
+
+CREATE INDEX IF NOT EXISTS pluto_cache_image_idx ON {{schema}}.pluto_cache (pluto_image_uuid);
+
+CREATE TABLE IF NOT EXISTS {{schema}}.pluto_context_rules (
+    id            serial PRIMARY KEY,
+    context       text NOT NULL,
+    identifier    text NOT NULL,
+    max_width     integer,
+    max_height    integer,
+    max_file_size bigint,
+    compression   integer
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS pluto_context_rules_context_identifier_key
+    ON {{schema}}.pluto_context_rules (context, identifier);
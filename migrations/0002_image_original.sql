@@ -0,0 +1,7 @@
+-- Uploaded originals, kept byte-for-byte next to the normalized master.
+
+ALTER TABLE {{schema}}.pluto_image
+    ADD COLUMN IF NOT EXISTS original_gen_file_name text,
+    ADD COLUMN IF NOT EXISTS original_checksum      text,
+    ADD COLUMN IF NOT EXISTS original_size          bigint,
+    ADD COLUMN IF NOT EXISTS original_mime_type     text;
@@ -0,0 +1,6 @@
+-- Content-addressed deduplication of uploads, opt-in per context rule.
+
+ALTER TABLE {{schema}}.pluto_context_rules
+    ADD COLUMN IF NOT EXISTS deduplicate boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS pluto_image_checksum_idx ON {{schema}}.pluto_image (original_checksum);
@@ -0,0 +1,4 @@
+-- Perceptual hash of the master to find near-duplicate images, see DHash.
+
+ALTER TABLE {{schema}}.pluto_image
+    ADD COLUMN IF NOT EXISTS phash bigint;
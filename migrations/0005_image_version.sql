@@ -0,0 +1,34 @@
+-- History of replaced masters. uploaded_by and uploaded_at of pluto_image belong to
+-- the current master, created_by and created_at to the first upload.
+
+ALTER TABLE {{schema}}.pluto_image
+    ADD COLUMN IF NOT EXISTS version     integer NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS uploaded_by uuid,
+    ADD COLUMN IF NOT EXISTS uploaded_at timestamptz;
+
+UPDATE {{schema}}.pluto_image SET uploaded_by = created_by, uploaded_at = created_at WHERE uploaded_at IS NULL;
+
+ALTER TABLE {{schema}}.pluto_image ALTER COLUMN uploaded_at SET DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS {{schema}}.pluto_image_version (
+    id                     serial PRIMARY KEY,
+    pluto_image_uuid       uuid NOT NULL REFERENCES {{schema}}.pluto_image (uuid) ON DELETE CASCADE,
+    version                integer NOT NULL,
+    file_name              text,
+    gen_file_name          text NOT NULL,
+    width                  integer,
+    height                 integer,
+    mime_type              text,
+    exif                   jsonb,
+    original_gen_file_name text,
+    original_checksum      text,
+    original_size          bigint,
+    original_mime_type     text,
+    phash                  bigint,
+    created_by             uuid,
+    created_at             timestamptz,
+    replaced_by            uuid,
+    replaced_at            timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS pluto_image_version_image_idx ON {{schema}}.pluto_image_version (pluto_image_uuid);
@@ -1,11 +1,18 @@
 package pluto
 
-import "time"
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
 
 type ImageIdentifierValidator func(string) bool
 
 type ImageRefresherCallback func(entity string, uuids []string) TxFunc
 
+// UserResolver returns the uuid of the user making the request, an error rejects the request as unauthenticated
+type UserResolver func(gc *gin.Context) (string, error)
+
 type ImageMeta struct {
 	Uuid        *string        `json:"uuid"`
 	FileName    *string        `json:"file_name,omitempty"`
@@ -23,10 +30,18 @@ type ImageMeta struct {
 	FocusY      *float64       `json:"focus_y,omitempty"`
 }
 
+// ImageWriteResponse is returned by the upload and delete routes
+type ImageWriteResponse struct {
+	ImageUuid         string `json:"image_uuid"`
+	FileRemoved       bool   `json:"file_removed"`
+	CacheFilesRemoved int    `json:"cache_files_removed"`
+	Deduplicated      bool   `json:"deduplicated,omitempty"` // upload matched an existing image
+}
+
 type CacheEntry struct {
 	Id        int       `json:"id"`
 	Receipt   string    `json:"receipt"`
-	ImageId   *int      `json:"image_id,omitempty"`
+	ImageId   *string   `json:"image_id,omitempty"` // uuid of the image
 	CreatedAt time.Time `json:"created_at"`
 	MimeType  *string   `json:"mime_type,omitempty"`
 }
@@ -0,0 +1,158 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+
+	"github.com/disintegration/imaging"
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultSimilarDistance is the Hamming distance up to which images count as near-duplicates
+const DefaultSimilarDistance = 10
+
+// MaxSimilarDistance limits the requested distance, far beyond it every image matches
+const MaxSimilarDistance = 16
+
+// MaxSimilarImages limits the images returned by a search, closest first
+const MaxSimilarImages = 50
+
+// ErrNoImageHash is returned for images stored before perceptual hashes were computed,
+// RegenerateMasters computes the missing ones.
+var ErrNoImageHash = errors.New("image has no perceptual hash")
+
+// SimilarImage is an image found by FindSimilarImages
+type SimilarImage struct {
+	Uuid     string `json:"uuid"`
+	Distance int    `json:"distance"` // differing bits, 0 = identical hash
+}
+
+// DHash computes the difference hash of an image. The image is reduced to 9x8 gray
+// pixels, each bit tells whether a pixel is brighter than its right neighbour. Copies
+// resized or compressed differently differ in few bits.
+func DHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x*4] > row[(x+1)*4] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// HammingDistance returns the number of bits in which two hashes differ
+func HammingDistance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// ImageHash decodes an image and returns its DHash
+func ImageHash(data []byte, mimeType string) (uint64, error) {
+	img, err := decodeImage(data, mimeType)
+	if err != nil {
+		return 0, err
+	}
+	return DHash(img), nil
+}
+
+// FindSimilarImages returns the images whose hash is within maxDistance of hash,
+// closest first and at most MaxSimilarImages. maxDistance is limited to MaxSimilarDistance.
+func (pluto *Pluto) FindSimilarImages(ctx context.Context, hash uint64, maxDistance int) ([]SimilarImage, error) {
+	return pluto.findSimilarImages(ctx, hash, maxDistance, "", nil)
+}
+
+// FindSimilarToImage returns the images within maxDistance of an image, the image
+// itself excluded. pgx.ErrNoRows is returned if the image does not exist.
+func (pluto *Pluto) FindSimilarToImage(ctx context.Context, imageUuid string, maxDistance int) ([]SimilarImage, error) {
+	hash, err := pluto.imagePHash(ctx, imageUuid)
+	if err != nil {
+		return nil, err
+	}
+	return pluto.findSimilarImages(ctx, hash, maxDistance, imageUuid, nil)
+}
+
+// imagePHash returns the stored hash of an image, ErrNoImageHash if it has none
+func (pluto *Pluto) imagePHash(ctx context.Context, imageUuid string) (uint64, error) {
+	var hash *int64
+	query := fmt.Sprintf(`SELECT phash FROM %s.pluto_image WHERE uuid = $1::uuid`, pluto.DbSchema)
+	if err := pluto.DbPool.QueryRow(ctx, query, imageUuid).Scan(&hash); err != nil {
+		return 0, err
+	}
+	if hash == nil {
+		return 0, ErrNoImageHash
+	}
+	return uint64(*hash), nil
+}
+
+// findSimilarImages computes the distances in the database (bit_count needs PostgreSQL 14),
+// excludeUuid is left out if not empty. Images rejected by allow, if not nil, do not count
+// towards MaxSimilarImages, further pages are read until enough images are allowed.
+func (pluto *Pluto) findSimilarImages(
+	ctx context.Context,
+	hash uint64,
+	maxDistance int,
+	excludeUuid string,
+	allow func(imageUuid string) (bool, error),
+) ([]SimilarImage, error) {
+	maxDistance = clampInt(maxDistance, 0, MaxSimilarDistance)
+
+	// Pages continue after the last image of the previous one
+	query := fmt.Sprintf(
+		`SELECT uuid::text, distance FROM (
+			SELECT uuid, bit_count((phash # $1::bigint)::bit(64))::int AS distance
+			FROM %s.pluto_image
+			WHERE phash IS NOT NULL AND ($2 = '' OR uuid::text <> lower($2))
+		 ) similar
+		 WHERE distance <= $3 AND (distance, uuid) > ($5::int, $6::uuid)
+		 ORDER BY distance, uuid
+		 LIMIT $4`,
+		pluto.DbSchema)
+
+	similar := []SimilarImage{}
+	after := SimilarImage{Uuid: "00000000-0000-0000-0000-000000000000", Distance: -1}
+	for {
+		rows, err := pluto.DbPool.Query(ctx, query, int64(hash), excludeUuid, maxDistance, MaxSimilarImages, after.Distance, after.Uuid)
+		if err != nil {
+			return nil, fmt.Errorf("Query failed: %w", err)
+		}
+
+		page, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SimilarImage, error) {
+			var image SimilarImage
+			err := row.Scan(&image.Uuid, &image.Distance)
+			return image, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, image := range page {
+			if allow != nil {
+				allowed, err := allow(image.Uuid)
+				if err != nil {
+					return nil, err
+				}
+				if !allowed {
+					continue
+				}
+			}
+			similar = append(similar, image)
+			if len(similar) == MaxSimilarImages {
+				return similar, nil
+			}
+		}
+
+		if len(page) < MaxSimilarImages {
+			return similar, nil
+		}
+		after = page[len(page)-1]
+	}
+}
@@ -0,0 +1,74 @@
+package pluto
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// testImage draws a gradient with a bright square, so the hash has set and unset bits
+func testImage(w, h int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 200 / w)
+			if x > w/4 && x < w/2 && y > h/4 && y < h/2 {
+				v = 255
+			}
+			img.Set(x, y, color.NRGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func TestDHash(t *testing.T) {
+	original := testImage(800, 600)
+	hash := DHash(original)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Resize(original, 320, 0, imaging.Lanczos), &jpeg.Options{Quality: 40}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := ImageHash(buf.Bytes(), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		hash        uint64
+		maxDistance int
+		minDistance int
+	}{
+		{"same image", DHash(original), 0, 0},
+		{"resized and recompressed", recompressed, DefaultSimilarDistance, 0},
+		{"mirrored", DHash(imaging.FlipH(original)), 64, DefaultSimilarDistance + 1},
+	}
+	for _, tt := range tests {
+		distance := HammingDistance(hash, tt.hash)
+		if distance > tt.maxDistance || distance < tt.minDistance {
+			t.Errorf("%s: distance %d, want %d - %d", tt.name, distance, tt.minDistance, tt.maxDistance)
+		}
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0xff, 0x0f, 4},
+		{0, ^uint64(0), 64},
+	}
+	for _, tt := range tests {
+		if got := HammingDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("HammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
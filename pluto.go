@@ -1,13 +1,13 @@
 package pluto
 
 import (
-	_ "context"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	_ "log"
-	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -19,30 +19,106 @@ type Pluto struct {
 	Verbose  bool
 	DbPool   *pgxpool.Pool
 	DbSchema string
+
+	// Storages for original images and cache files, created from the config
+	ImageStorage Storage
+	CacheStorage Storage
+
+	// Authorizer is consulted for every image request, see Authorizer for the defaults
+	Authorizer Authorizer
+
+	// ResolveUser identifies the user of upload and delete requests, nil denies them
+	ResolveUser UserResolver
+
+	renders       renderGroup
+	renderLimiter *renderLimiter
+	opaque        sync.Map // master file name: bool, see sourceOpaque
 }
 
+// PlutoInstance is the instance created by the most recent Initialize, used by the package level functions
 var PlutoInstance *Pluto
 
-// New creates and initializes a new Pluto instance
-func Initialize(configFilePath string, pool *pgxpool.Pool, verbose bool) (*Pluto, error) {
+// Option configures Initialize
+type Option func(*initOptions)
+
+type initOptions struct {
+	autoMigrate bool
+	schemaCheck bool
+}
+
+// WithAutoMigrate applies pending schema migrations during Initialize
+func WithAutoMigrate() Option {
+	return func(o *initOptions) {
+		o.autoMigrate = true
+	}
+}
+
+// WithSchemaCheck makes Initialize fail if the database schema version does not match
+func WithSchemaCheck() Option {
+	return func(o *initOptions) {
+		o.schemaCheck = true
+	}
+}
+
+// Initialize loads the config file and creates a new Pluto instance
+func Initialize(configFilePath string, pool *pgxpool.Pool, verbose bool, opts ...Option) (*Pluto, error) {
+	config, err := LoadConfig(configFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config: %w", err)
+	}
+	config.Print()
+
+	pluto, err := New(config, pool, verbose, opts...)
+	if err != nil {
+		return nil, err
+	}
+	PlutoInstance = pluto
+
+	return pluto, nil
+}
+
+// New creates and initializes a new Pluto instance from a config, it does not replace PlutoInstance
+func New(config Config, pool *pgxpool.Pool, verbose bool, opts ...Option) (*Pluto, error) {
 	pluto := &Pluto{}
 
+	var options initOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	pluto.Verbose = verbose
 	pluto.DbPool = pool
 
-	pluto.Log("loading configuration")
-	if err := pluto.loadConfig(configFilePath); err != nil {
-		return nil, fmt.Errorf("Failed to load config: %w", err)
+	pluto.Log("check configuration")
+	pluto.Config = config
+	if err := pluto.checkConfig(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %w", err)
 	}
 
+	pluto.DbSchema = pluto.Config.DbSchema
+
 	pluto.Log("prepare sql")
-	if err := pluto.prepareSql(); err != nil {
+	if err := pluto.prepareSql(options); err != nil {
 		return nil, fmt.Errorf("Failed to prepare SQL: %w", err)
 	}
 
-	pluto.DbSchema = pluto.Config.DbSchema
+	pluto.Log("create storage")
+	imageStorage, cacheStorage, err := newStorages(pluto.Config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create storage: %w", err)
+	}
+	pluto.ImageStorage = imageStorage
+	pluto.CacheStorage = cacheStorage
 
-	PlutoInstance = pluto
+	pluto.renderLimiter = newRenderLimiter(
+		pluto.Config.PlutoRenderConcurrency,
+		pluto.Config.PlutoRenderQueueSize,
+		time.Duration(pluto.Config.PlutoRenderQueueTimeout)*time.Second)
+
+	pluto.Log("check presets")
+	if err := pluto.checkPresets(); err != nil {
+		return nil, fmt.Errorf("Failed to check presets: %w", err)
+	}
 
 	return pluto, nil
 }
@@ -53,39 +129,60 @@ func (pluto *Pluto) Log(msg string) {
 	}
 }
 
-func (pluto *Pluto) loadConfig(configFilePath string) error {
-	pluto.Config = DefaultConfig()
-
-	file, err := os.Open(configFilePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+func (pluto *Pluto) checkConfig() error {
+	pluto.Config.PlutoRoute = strings.Trim(pluto.Config.PlutoRoute, "/")
 
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return err
+	if pluto.Config.PlutoDimensionMode != DimensionModeSnap && pluto.Config.PlutoDimensionMode != DimensionModeReject {
+		return fmt.Errorf("invalid pluto_dimension_mode: %s", pluto.Config.PlutoDimensionMode)
 	}
-
-	err = json.Unmarshal(bytes, &pluto.Config)
-	if err != nil {
-		return err
+	sort.Ints(pluto.Config.PlutoAllowedWidths)
+	sort.Ints(pluto.Config.PlutoAllowedHeights)
+	for _, ratio := range pluto.Config.PlutoAllowedRatios {
+		if _, err := ParseAspectRatio(ratio); err != nil {
+			return fmt.Errorf("invalid pluto_allowed_ratios entry: %s", ratio)
+		}
 	}
 
-	pluto.Config.PlutoRoute = strings.Trim(pluto.Config.PlutoRoute, "/")
-	pluto.Config.Print()
-
 	return nil
 }
 
-func (pluto *Pluto) prepareSql() error {
+func (pluto *Pluto) prepareSql(options initOptions) error {
+	ctx := context.Background()
+
+	if options.autoMigrate {
+		if err := pluto.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	if options.schemaCheck {
+		if err := pluto.CheckSchema(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (pluto *Pluto) RegisterRoutes(rg *gin.RouterGroup, middlewares ...gin.HandlerFunc) {
-	group := rg.Group("/" + pluto.Config.PlutoRoute)
-	group.GET("/:uuid/", getImage)
-	group.GET("/file/:file", getFile)
-	group.GET("/meta/:context/:contextUuid/:identifier", getImageMeta)
-	group.GET("/cache/:imageUuid", getImageCache)
+	group := rg.Group("/"+pluto.Config.PlutoRoute, middlewares...)
+	group.GET("/:uuid/", pluto.getImage)
+	group.GET("/:uuid/:preset", pluto.getImage)
+	group.GET("/file/:file", pluto.getFile)
+	group.GET("/original/:uuid", pluto.getImageOriginal)
+	group.GET("/meta/:context/:contextUuid/:identifier", pluto.getImageMeta)
+	group.GET("/meta/:context/:contextUuid/:identifier/srcset", pluto.getImageSrcsetByContext)
+	group.GET("/srcset/:uuid", pluto.getImageSrcset)
+	group.GET("/cache/:imageUuid", pluto.getImageCache)
+	group.GET("/similar/:uuid", pluto.getSimilarImages)
+	group.GET("/versions/:uuid", pluto.getImageVersions)
+
+	if pluto.Config.PlutoEnableWriteRoutes {
+		group.POST("/:context/:contextUuid/:identifier", pluto.putImageByContext)
+		group.PUT("/:context/:contextUuid/:identifier", pluto.putImageByContext)
+		group.DELETE("/:context/:contextUuid/:identifier", pluto.deleteImageByContext)
+		group.POST("/:context/:contextUuid/:identifier/link", pluto.linkImageByContext)
+		group.POST("/:context/:contextUuid/:identifier/similar", pluto.postSimilarImages)
+		group.POST("/:context/:contextUuid/:identifier/versions/:versionId/restore", pluto.restoreImageVersion)
+	}
 }
@@ -0,0 +1,79 @@
+package pluto
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// imageOptionKeys are the query parameters parsed by ParseImageOptions, except dpr
+var imageOptionKeys = []string{"type", "fit", "background", "quality", "width", "height", "ratio", "lossless", "speed"}
+
+var (
+	ErrUnknownPreset    = errors.New("unknown preset")
+	ErrPresetRequired   = errors.New("preset is required")
+	ErrPresetWithParams = errors.New("preset can't be combined with transformation parameters")
+)
+
+// PresetQuery returns the query parameters of a configured preset.
+func (pluto *Pluto) PresetQuery(name string) (url.Values, error) {
+	presetStr, ok := pluto.Config.PlutoPresets[name]
+	if !ok {
+		return nil, ErrUnknownPreset
+	}
+	query, err := url.ParseQuery(presetStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preset %s: %w", name, err)
+	}
+	return query, nil
+}
+
+// resolveImageQuery returns the transformation parameters of a request. With a
+// preset, the parameters come from the configuration, only dpr can be added.
+func (pluto *Pluto) resolveImageQuery(presetName string, query url.Values) (url.Values, error) {
+	if presetName == "" {
+		if pluto.Config.PlutoPresetsOnly {
+			return nil, ErrPresetRequired
+		}
+		return query, nil
+	}
+
+	for _, key := range imageOptionKeys {
+		if query.Has(key) {
+			return nil, ErrPresetWithParams
+		}
+	}
+
+	presetQuery, err := pluto.PresetQuery(presetName)
+	if err != nil {
+		return nil, err
+	}
+	if dpr, ok := queryValue(query, "dpr"); ok {
+		presetQuery.Set("dpr", dpr)
+	}
+	return presetQuery, nil
+}
+
+// checkPresets validates all configured presets
+func (pluto *Pluto) checkPresets() error {
+	for name := range pluto.Config.PlutoPresets {
+		query, err := pluto.PresetQuery(name)
+		if err != nil {
+			return err
+		}
+		if _, err := pluto.ParseImageOptions(query); err != nil {
+			return fmt.Errorf("invalid preset %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PresetURL builds the getImage URL for an image uuid and a configured preset.
+func (pluto *Pluto) PresetURL(imageUuid string, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s",
+		strings.TrimRight(pluto.Config.BaseApiUrl, "/"),
+		pluto.Config.PlutoRoute,
+		imageUuid,
+		url.PathEscape(name))
+}
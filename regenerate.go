@@ -0,0 +1,191 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RegenerateOptions configures RegenerateMasters
+type RegenerateOptions struct {
+	ImageUuid string // only this image, all images if empty
+	DryRun    bool
+}
+
+// RegenerateResult reports the outcome of RegenerateMasters. Images uploaded
+// before originals were kept, and images replaced or deleted meanwhile, are skipped.
+type RegenerateResult struct {
+	Regenerated int               `json:"regenerated"`
+	Skipped     int               `json:"skipped"`
+	Failed      map[string]string `json:"failed,omitempty"` // image uuid: error
+}
+
+// RegenerateMasters derives the normalized masters again from the stored originals,
+// with the current max size, quality and context rules, and purges their cache.
+func (pluto *Pluto) RegenerateMasters(ctx context.Context, opts RegenerateOptions) (RegenerateResult, error) {
+	result := RegenerateResult{Failed: map[string]string{}}
+
+	query := fmt.Sprintf(
+		`SELECT uuid::text, gen_file_name, original_gen_file_name, original_mime_type
+		 FROM %s.pluto_image
+		 WHERE $1 = '' OR uuid::text = $1
+		 ORDER BY uuid`,
+		pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query, opts.ImageUuid)
+	if err != nil {
+		return result, fmt.Errorf("Query failed: %w", err)
+	}
+
+	type image struct {
+		uuid, genFileName                     string
+		originalGenFileName, originalMimeType *string
+	}
+	var images []image
+	for rows.Next() {
+		var img image
+		if err := rows.Scan(&img.uuid, &img.genFileName, &img.originalGenFileName, &img.originalMimeType); err != nil {
+			rows.Close()
+			return result, err
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, img := range images {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		if img.originalGenFileName == nil || *img.originalGenFileName == "" || img.originalMimeType == nil {
+			result.Skipped++
+			continue
+		}
+
+		if opts.DryRun {
+			result.Regenerated++
+			continue
+		}
+
+		if err := pluto.regenerateMaster(ctx, img.uuid, img.genFileName, *img.originalGenFileName, *img.originalMimeType); err != nil {
+			if errors.Is(err, errImageChanged) {
+				result.Skipped++
+				continue
+			}
+			result.Failed[img.uuid] = err.Error()
+			continue
+		}
+		result.Regenerated++
+	}
+
+	return result, nil
+}
+
+// errImageChanged skips an image whose files were replaced or which was deleted during the regeneration
+var errImageChanged = errors.New("image changed during regeneration")
+
+// regenerateMaster renders the master from the original and overwrites it, unless
+// the image no longer uses these files
+func (pluto *Pluto) regenerateMaster(
+	ctx context.Context,
+	imageUuid string,
+	genFileName string,
+	originalGenFileName string,
+	originalMimeType string,
+) error {
+	maxWidth, maxHeight, quality, err := pluto.masterLimits(ctx, imageUuid)
+	if err != nil {
+		return err
+	}
+
+	original, err := pluto.ImageStorage.Get(ctx, originalGenFileName)
+	if err != nil {
+		return fmt.Errorf("Failed to read original: %w", err)
+	}
+
+	release, err := pluto.renderLimiter.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	master, err := pluto.normalizeImage(original, originalMimeType, maxWidth, maxHeight, quality)
+	release()
+	if err != nil {
+		return err
+	}
+
+	// An upload may have replaced the files since they were listed, the lock keeps
+	// it from doing so until the new master is written
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
+		if err := pluto.lockImageTx(ctx, tx, imageUuid); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return &ApiTxError{Err: errImageChanged}
+			}
+			return ApiErrInternal("Failed to lock pluto_image: %w", err)
+		}
+
+		query := fmt.Sprintf(
+			`UPDATE %s.pluto_image SET width = $4, height = $5, mime_type = $6, phash = $7
+			 WHERE uuid = $1::uuid AND gen_file_name = $2 AND original_gen_file_name = $3`,
+			pluto.DbSchema)
+		tag, err := tx.Exec(ctx, query, imageUuid, genFileName, originalGenFileName,
+			master.Width, master.Height, master.MimeType, int64(master.PHash))
+		if err != nil {
+			return ApiErrInternal("Update pluto_image failed: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return &ApiTxError{Err: errImageChanged}
+		}
+
+		if err := pluto.ImageStorage.Put(ctx, genFileName, master.Data, master.MimeType); err != nil {
+			return ApiErrInternal("Failed to save file: %w", err)
+		}
+		return nil
+	})
+	if txErr != nil {
+		return txErr.Err
+	}
+
+	_, err = pluto.PurgeCache(ctx, CachePurgeFilter{ImageUuid: imageUuid})
+	return err
+}
+
+// masterLimits returns the size and quality limits for the master of an image, the
+// context rule of its first link overrides the config.
+func (pluto *Pluto) masterLimits(ctx context.Context, imageUuid string) (maxWidth int, maxHeight int, quality int, err error) {
+	maxWidth = pluto.Config.PlutoMaxImagePx
+	maxHeight = pluto.Config.PlutoMaxImagePx
+	quality = pluto.Config.PlutoDefaultQuality
+
+	link, err := pluto.loadImageLink(ctx, imageUuid)
+	if err != nil || link.Context == "" {
+		return maxWidth, maxHeight, quality, err
+	}
+
+	var ruleMaxWidth, ruleMaxHeight, ruleCompression *int
+	query := fmt.Sprintf(
+		`SELECT max_width, max_height, compression FROM %s.pluto_context_rules WHERE context = $1 AND identifier = $2`,
+		pluto.DbSchema)
+	err = pluto.DbPool.QueryRow(ctx, query, link.Context, link.Identifier).Scan(&ruleMaxWidth, &ruleMaxHeight, &ruleCompression)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return maxWidth, maxHeight, quality, nil
+		}
+		return maxWidth, maxHeight, quality, err
+	}
+
+	if ruleMaxWidth != nil {
+		maxWidth = *ruleMaxWidth
+	}
+	if ruleMaxHeight != nil {
+		maxHeight = *ruleMaxHeight
+	}
+	if ruleCompression != nil {
+		quality = *ruleCompression
+	}
+
+	return maxWidth, maxHeight, quality, nil
+}
@@ -0,0 +1,78 @@
+package pluto
+
+import (
+	"context"
+	"sync"
+)
+
+// renderCall is an in-flight render of one cache receipt
+type renderCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	data    []byte
+	err     error
+}
+
+// renderGroup coalesces concurrent renders of the same cache file, so only one
+// request decodes, transforms and encodes while the others wait for its result.
+// The render is cancelled when all waiting requests are gone.
+// The zero value is ready to use.
+type renderGroup struct {
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+// Do executes fn once per key at a time. Concurrent callers with the same key
+// wait for the running call and receive its result, shared reports this.
+// If ctx is done before the result is available, Do returns ctx.Err().
+func (g *renderGroup) Do(
+	ctx context.Context,
+	key string,
+	fn func(ctx context.Context) ([]byte, error),
+) (data []byte, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*renderCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		renderCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &renderCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+
+		go func() {
+			call.data, call.err = fn(renderCtx)
+			g.forget(key, call)
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.data, call.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody waits anymore, later requests must start a new render
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+func (g *renderGroup) forget(key string, call *renderCall) {
+	g.mu.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+}
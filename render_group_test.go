@@ -0,0 +1,89 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderGroupCoalesces(t *testing.T) {
+	var g renderGroup
+	var calls atomic.Int32
+	start := make(chan struct{})
+
+	fn := func(ctx context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-start
+		return []byte("image"), nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var shared atomic.Int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err, isShared := g.Do(context.Background(), "key", fn)
+			if err != nil || string(data) != "image" {
+				t.Errorf("Do = %q, %v", data, err)
+			}
+			if isShared {
+				shared.Add(1)
+			}
+		}()
+	}
+
+	// Let all callers join the running render
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("fn ran %d times, want 1", calls.Load())
+	}
+	if shared.Load() != callers-1 {
+		t.Errorf("%d callers shared the result, want %d", shared.Load(), callers-1)
+	}
+
+	// A finished render is not reused
+	g.Do(context.Background(), "key", func(ctx context.Context) ([]byte, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+	if calls.Load() != 2 {
+		t.Errorf("fn ran %d times after the first render, want 2", calls.Load())
+	}
+}
+
+func TestRenderGroupCancelsAbandonedRender(t *testing.T) {
+	var g renderGroup
+	cancelled := make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err, _ := g.Do(ctx, "key", func(renderCtx context.Context) ([]byte, error) {
+		<-renderCtx.Done()
+		close(cancelled)
+		return nil, renderCtx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do = %v, want context.Canceled", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("render was not cancelled after the last caller left")
+	}
+}
@@ -0,0 +1,76 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRenderOverloaded is returned if no render slot becomes available in time
+var ErrRenderOverloaded = errors.New("image rendering overloaded, try again later")
+
+// renderLimiter bounds the number of concurrent decode/transform/encode jobs.
+// Jobs exceeding the limit wait in a bounded queue for at most queueTimeout.
+type renderLimiter struct {
+	slots        chan struct{}
+	waiting      atomic.Int32
+	queueSize    int32
+	queueTimeout time.Duration
+}
+
+func newRenderLimiter(concurrency int, queueSize int, queueTimeout time.Duration) *renderLimiter {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	return &renderLimiter{
+		slots:        make(chan struct{}, concurrency),
+		queueSize:    int32(max(queueSize, 0)),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire blocks until a render slot is free, the queue timeout expires or ctx is done.
+// The returned function releases the slot. A nil limiter doesn't limit anything.
+func (l *renderLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	release := func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if l.waiting.Add(1) > l.queueSize {
+		l.waiting.Add(-1)
+		return nil, ErrRenderOverloaded
+	}
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ErrRenderOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RetryAfter returns the value for the Retry-After header of overloaded responses
+func (l *renderLimiter) RetryAfter() string {
+	seconds := 1
+	if l != nil {
+		seconds = max(1, int(l.queueTimeout.Seconds()))
+	}
+	return strconv.Itoa(seconds)
+}
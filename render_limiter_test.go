@@ -0,0 +1,63 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenderLimiter(t *testing.T) {
+	l := newRenderLimiter(1, 1, 20*time.Millisecond)
+
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued request times out while the slot is taken
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, ErrRenderOverloaded) {
+		t.Errorf("Acquire with busy slot = %v, want ErrRenderOverloaded", err)
+	}
+
+	// A full queue rejects immediately
+	queued := make(chan error)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		queued <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := l.Acquire(context.Background()); !errors.Is(err, ErrRenderOverloaded) {
+		t.Errorf("Acquire with full queue = %v, want ErrRenderOverloaded", err)
+	}
+	<-queued
+
+	// A cancelled request leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire with cancelled context = %v, want context.Canceled", err)
+	}
+
+	// A released slot is available again
+	release()
+	release, err = l.Acquire(context.Background())
+	if err != nil {
+		t.Errorf("Acquire after release = %v", err)
+	} else {
+		release()
+	}
+
+	if got := l.RetryAfter(); got != "1" {
+		t.Errorf("RetryAfter = %s, want 1", got)
+	}
+}
+
+func TestNilRenderLimiter(t *testing.T) {
+	var l *renderLimiter
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
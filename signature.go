@@ -0,0 +1,52 @@
+package pluto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ImageSignature computes the signature of an image uuid and its normalized
+// transformation parameters with the configured secret.
+func (pluto *Pluto) ImageSignature(imageUuid string, opts ImageOptions) string {
+	mac := hmac.New(sha256.New, []byte(pluto.Config.PlutoSignatureSecret))
+	mac.Write([]byte(imageUuid + "?" + opts.Query().Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL builds the getImage URL for an image uuid and transformation options.
+// Start with pluto.DefaultImageOptions() and override what is needed. The sig parameter
+// is only added if a signature secret is configured.
+func (pluto *Pluto) SignedURL(imageUuid string, opts ImageOptions) (string, error) {
+	// Round trip through the parser, so the signature covers exactly what getImage verifies
+	normalized, err := pluto.ParseImageOptions(opts.Query())
+	if err != nil {
+		return "", err
+	}
+
+	query := normalized.Query()
+	if pluto.Config.PlutoSignatureSecret != "" {
+		query.Set("sig", pluto.ImageSignature(imageUuid, normalized))
+	}
+
+	return fmt.Sprintf("%s/%s/%s/?%s",
+		strings.TrimRight(pluto.Config.BaseApiUrl, "/"),
+		pluto.Config.PlutoRoute,
+		imageUuid,
+		query.Encode()), nil
+}
+
+// verifyImageSignature checks the sig parameter of a request. Requests always pass
+// if no signature secret is configured.
+func (pluto *Pluto) verifyImageSignature(imageUuid string, opts ImageOptions, sig string) bool {
+	if pluto.Config.PlutoSignatureSecret == "" {
+		return true
+	}
+	if sig == "" {
+		return false
+	}
+	expected := pluto.ImageSignature(imageUuid, opts)
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
@@ -0,0 +1,120 @@
+package pluto
+
+import (
+	"context"
+	"fmt"
+)
+
+// StorageStats holds the number and total size of the objects in a storage
+type StorageStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Stats summarizes the database rows and storage usage of a Pluto instance
+type Stats struct {
+	Images         int          `json:"images"`
+	ImagesOriginal int          `json:"images_with_original"`
+	Links          int          `json:"links"`
+	CacheEntries   int          `json:"cache_entries"`
+	ImageStorage   StorageStats `json:"image_storage"`
+	CacheStorage   StorageStats `json:"cache_storage"`
+}
+
+// VerifyResult lists the images whose files are missing in the image storage
+type VerifyResult struct {
+	Checked int           `json:"checked"`
+	Missing []MissingFile `json:"missing"`
+}
+
+type MissingFile struct {
+	ImageUuid string `json:"image_uuid"`
+	FileName  string `json:"file_name"`
+	Original  bool   `json:"original"`
+}
+
+// Stats counts images, links and cache entries and sums up the storage usage
+func (pluto *Pluto) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+
+	query := fmt.Sprintf(`
+		SELECT
+			(SELECT COUNT(*) FROM %[1]s.pluto_image),
+			(SELECT COUNT(*) FROM %[1]s.pluto_image WHERE original_gen_file_name IS NOT NULL),
+			(SELECT COUNT(*) FROM %[1]s.pluto_image_link),
+			(SELECT COUNT(*) FROM %[1]s.pluto_cache)`,
+		pluto.DbSchema)
+	err := pluto.DbPool.QueryRow(ctx, query).Scan(&stats.Images, &stats.ImagesOriginal, &stats.Links, &stats.CacheEntries)
+	if err != nil {
+		return stats, fmt.Errorf("Query failed: %w", err)
+	}
+
+	if stats.ImageStorage, err = storageStats(ctx, pluto.ImageStorage); err != nil {
+		return stats, err
+	}
+	if stats.CacheStorage, err = storageStats(ctx, pluto.CacheStorage); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+func storageStats(ctx context.Context, storage Storage) (StorageStats, error) {
+	var stats StorageStats
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return stats, fmt.Errorf("List failed: %w", err)
+	}
+	for _, object := range objects {
+		stats.Files++
+		stats.Bytes += object.Size
+	}
+	return stats, nil
+}
+
+// Verify cross-checks gen_file_name and original_gen_file_name of all images against
+// the image storage and reports missing files.
+func (pluto *Pluto) Verify(ctx context.Context) (VerifyResult, error) {
+	var result VerifyResult
+
+	objects, err := pluto.ImageStorage.List(ctx, "")
+	if err != nil {
+		return result, fmt.Errorf("List failed: %w", err)
+	}
+	existing := make(map[string]struct{}, len(objects))
+	for _, object := range objects {
+		existing[object.Key] = struct{}{}
+	}
+
+	query := fmt.Sprintf(
+		`SELECT uuid::text, gen_file_name, original_gen_file_name FROM %s.pluto_image ORDER BY uuid`,
+		pluto.DbSchema)
+	rows, err := pluto.DbPool.Query(ctx, query)
+	if err != nil {
+		return result, fmt.Errorf("Query failed: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageUuid string
+		var genFileName, originalGenFileName *string
+		if err := rows.Scan(&imageUuid, &genFileName, &originalGenFileName); err != nil {
+			return result, err
+		}
+		result.Checked++
+
+		if genFileName == nil || *genFileName == "" {
+			result.Missing = append(result.Missing, MissingFile{ImageUuid: imageUuid})
+		} else if _, ok := existing[*genFileName]; !ok {
+			result.Missing = append(result.Missing, MissingFile{ImageUuid: imageUuid, FileName: *genFileName})
+		}
+
+		if originalGenFileName != nil && *originalGenFileName != "" {
+			if _, ok := existing[*originalGenFileName]; !ok {
+				result.Missing = append(result.Missing, MissingFile{ImageUuid: imageUuid, FileName: *originalGenFileName, Original: true})
+			}
+		}
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,119 @@
+package pluto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StorageObject describes a file kept in a Storage
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage abstracts where original images and cache files are kept. Keys are
+// plain file names. Missing keys are reported as errors matching fs.ErrNotExist.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Stat(ctx context.Context, key string) (StorageObject, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]StorageObject, error)
+}
+
+// storageToucher is implemented by storages able to mark a file as recently used
+type storageToucher interface {
+	Touch(ctx context.Context, key string, modTime time.Time) error
+}
+
+// storageLocalPather is implemented by storages keeping files on the local filesystem
+type storageLocalPather interface {
+	LocalPath(key string) string
+}
+
+// Storage backends
+const (
+	StorageFilesystem = "fs"
+	StorageS3         = "s3"
+)
+
+// newStorages creates the image and cache storage configured in config
+func newStorages(config Config) (imageStorage Storage, cacheStorage Storage, err error) {
+	if err := checkStorageLocations(config); err != nil {
+		return nil, nil, err
+	}
+
+	switch config.PlutoStorage {
+	case "", StorageFilesystem:
+		return NewFileStorage(config.PlutoImageDir), NewFileStorage(config.PlutoCacheDir), nil
+	case StorageS3:
+		imageStorage, err = NewS3Storage(config, config.PlutoS3ImagePrefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		cacheStorage, err = NewS3Storage(config, config.PlutoS3CachePrefix)
+		if err != nil {
+			return nil, nil, err
+		}
+		return imageStorage, cacheStorage, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage: %s", config.PlutoStorage)
+	}
+}
+
+// checkStorageLocations rejects image and cache locations containing each other.
+// The image cleanup would take the cache files for orphaned images and delete them.
+func checkStorageLocations(config Config) error {
+	switch config.PlutoStorage {
+	case "", StorageFilesystem:
+		imageDir, err := filepath.Abs(config.PlutoImageDir)
+		if err != nil {
+			return err
+		}
+		cacheDir, err := filepath.Abs(config.PlutoCacheDir)
+		if err != nil {
+			return err
+		}
+		if pathContains(imageDir, cacheDir) || pathContains(cacheDir, imageDir) {
+			return fmt.Errorf("pluto_image_dir %s and pluto_cache_dir %s must not contain each other", imageDir, cacheDir)
+		}
+	case StorageS3:
+		imagePrefix, cachePrefix := config.PlutoS3ImagePrefix, config.PlutoS3CachePrefix
+		if strings.HasPrefix(imagePrefix, cachePrefix) || strings.HasPrefix(cachePrefix, imagePrefix) {
+			return fmt.Errorf("pluto_s3_image_prefix %q and pluto_s3_cache_prefix %q must not contain each other", imagePrefix, cachePrefix)
+		}
+	}
+	return nil
+}
+
+// pathContains reports whether path is dir or inside of it, both must be clean absolute paths
+func pathContains(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// DeleteStorageWithPrefix deletes all files in a storage that start with the given prefix.
+// Returns the number of deleted files and an error (if any).
+func DeleteStorageWithPrefix(ctx context.Context, storage Storage, prefix string) (int, error) {
+	if len(prefix) < 1 {
+		return 0, errors.New("Prefix required")
+	}
+	objects, err := storage.List(ctx, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list files: %w", err)
+	}
+	deletedCount := 0
+	for _, object := range objects {
+		if err := storage.Delete(ctx, object.Key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return deletedCount, fmt.Errorf("Failed to delete %s: %w", object.Key, err)
+		}
+		deletedCount++
+	}
+	return deletedCount, nil
+}
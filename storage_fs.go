@@ -0,0 +1,81 @@
+package pluto
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStorage keeps files in a directory of the local filesystem
+type FileStorage struct {
+	Dir string
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+func (s *FileStorage) LocalPath(key string) string {
+	return filepath.Join(s.Dir, filepath.Base(key))
+}
+
+// Put writes the file atomically, readers never see partial files
+func (s *FileStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := os.MkdirAll(s.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.LocalPath(key), data, 0644)
+}
+
+func (s *FileStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(s.LocalPath(key))
+}
+
+func (s *FileStorage) Stat(ctx context.Context, key string) (StorageObject, error) {
+	info, err := os.Stat(s.LocalPath(key))
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if info.IsDir() {
+		return StorageObject{}, &os.PathError{Op: "stat", Path: s.LocalPath(key), Err: os.ErrNotExist}
+	}
+	return StorageObject{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *FileStorage) Delete(ctx context.Context, key string) error {
+	return os.Remove(s.LocalPath(key))
+}
+
+// List returns all files in the directory starting with prefix. Hidden files,
+// like temporary files of running writes, are skipped.
+func (s *FileStorage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []StorageObject
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed in the meantime
+		}
+		objects = append(objects, StorageObject{Key: name, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+// Move renames a file, replacing an existing file atomically
+func (s *FileStorage) Move(ctx context.Context, from string, to string) error {
+	return os.Rename(s.LocalPath(from), s.LocalPath(to))
+}
+
+// Touch updates the access time and keeps the modification time
+func (s *FileStorage) Touch(ctx context.Context, key string, modTime time.Time) error {
+	return os.Chtimes(s.LocalPath(key), time.Now(), modTime)
+}
@@ -0,0 +1,110 @@
+package pluto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Storage keeps files in a bucket of an S3 compatible object storage (AWS S3, MinIO, ...).
+// All keys are stored below prefix.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Storage(config Config, prefix string) (*S3Storage, error) {
+	client, err := minio.New(config.PlutoS3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.PlutoS3AccessKey, config.PlutoS3SecretKey, ""),
+		Secure: config.PlutoS3UseSSL,
+		Region: config.PlutoS3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create S3 client: %w", err)
+	}
+	return &S3Storage{client: client, bucket: config.PlutoS3Bucket, prefix: prefix}, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(
+		ctx, s.bucket, s.prefix+key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	return s.mapError(key, err)
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.mapError(key, err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, s.mapError(key, err)
+	}
+	return data, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (StorageObject, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return StorageObject{}, s.mapError(key, err)
+	}
+	return StorageObject{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	// S3 doesn't report missing keys on delete, keep the filesystem semantics
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return s.mapError(key, s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix + prefix,
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, StorageObject{
+			Key:     strings.TrimPrefix(info.Key, s.prefix),
+			Size:    info.Size,
+			ModTime: info.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// Move copies the object on the server side and removes the source
+func (s *S3Storage) Move(ctx context.Context, from string, to string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.prefix + to},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.prefix + from})
+	if err != nil {
+		return s.mapError(from, err)
+	}
+	return s.mapError(from, s.client.RemoveObject(ctx, s.bucket, s.prefix+from, minio.RemoveObjectOptions{}))
+}
+
+// mapError reports missing keys as fs.ErrNotExist
+func (s *S3Storage) mapError(key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+		return &fs.PathError{Op: "s3", Path: s.prefix + key, Err: fs.ErrNotExist}
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package pluto
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// stagingPrefix marks files written by running transactions. Leftovers of crashed
+// processes are removed by the image cleanup once they are older than stagingMinAge
+// and its minimum age.
+const stagingPrefix = "staging_"
+
+// stagingMinAge protects staged files of running transactions from the image cleanup,
+// whatever its configured minimum age
+const stagingMinAge = time.Hour
+
+// storageMover is implemented by storages able to rename a file cheaply
+type storageMover interface {
+	Move(ctx context.Context, from string, to string) error
+}
+
+// fileStage writes files under a temporary key while a transaction runs. Promote
+// moves them to their final key as the last step of the transaction, Commit deletes
+// the superseded files after the commit, Rollback discards the staged and promoted files.
+type fileStage struct {
+	storage    Storage
+	id         string
+	staged     []stagedFile
+	promoted   []string
+	superseded []string
+}
+
+type stagedFile struct {
+	tmpKey      string
+	key         string
+	contentType string
+}
+
+func newFileStage(storage Storage) *fileStage {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return &fileStage{storage: storage, id: hex.EncodeToString(b)}
+}
+
+// Put writes data to a staging key, it is moved to key on Promote
+func (s *fileStage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	tmpKey := stagingPrefix + s.id + "_" + key
+	if err := s.storage.Put(ctx, tmpKey, data, contentType); err != nil {
+		return err
+	}
+	s.staged = append(s.staged, stagedFile{tmpKey: tmpKey, key: key, contentType: contentType})
+	return nil
+}
+
+// Supersede marks files to delete on Commit, empty keys are ignored
+func (s *fileStage) Supersede(keys ...string) {
+	for _, key := range keys {
+		if key != "" {
+			s.superseded = append(s.superseded, key)
+		}
+	}
+}
+
+// Promote moves the staged files to their final keys. It is called last inside the
+// transaction, so the files exist before other transactions can see rows naming them.
+func (s *fileStage) Promote(ctx context.Context) error {
+	for len(s.staged) > 0 {
+		file := s.staged[0]
+		if err := moveStorageFile(ctx, s.storage, file); err != nil {
+			return fmt.Errorf("Failed to promote %s: %w", file.key, err)
+		}
+		s.staged = s.staged[1:]
+		s.promoted = append(s.promoted, file.key)
+	}
+	return nil
+}
+
+// Commit deletes the superseded files not overwritten by promoted ones, it is called
+// after the transaction committed
+func (s *fileStage) Commit(ctx context.Context) {
+	promoted := map[string]bool{}
+	for _, key := range s.promoted {
+		promoted[key] = true
+	}
+
+	for _, key := range s.superseded {
+		if promoted[key] {
+			continue
+		}
+		if err := s.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: failed to delete superseded file %s: %v\n", key, err)
+		}
+	}
+}
+
+// Rollback deletes the staged files and the files already promoted
+func (s *fileStage) Rollback(ctx context.Context) {
+	for _, file := range s.staged {
+		if err := s.storage.Delete(ctx, file.tmpKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: failed to discard staged file %s: %v\n", file.tmpKey, err)
+		}
+	}
+	for _, key := range s.promoted {
+		if err := s.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Warning: failed to discard promoted file %s: %v\n", key, err)
+		}
+	}
+	s.staged = nil
+	s.promoted = nil
+}
+
+func moveStorageFile(ctx context.Context, storage Storage, file stagedFile) error {
+	if mover, ok := storage.(storageMover); ok {
+		return mover.Move(ctx, file.tmpKey, file.key)
+	}
+
+	data, err := storage.Get(ctx, file.tmpKey)
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(ctx, file.key, data, file.contentType); err != nil {
+		return err
+	}
+	return storage.Delete(ctx, file.tmpKey)
+}
+
+// contextWithoutCancel is used by functions whose context parameter shadows the package
+func contextWithoutCancel(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
@@ -0,0 +1,79 @@
+package pluto
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckStorageLocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(*Config)
+		wantErr bool
+	}{
+		{"separate dirs", func(c *Config) { c.PlutoImageDir, c.PlutoCacheDir = "/srv/images", "/srv/cache" }, false},
+		{"similar names", func(c *Config) { c.PlutoImageDir, c.PlutoCacheDir = "/srv/img", "/srv/img-cache" }, false},
+		{"same dir", func(c *Config) { c.PlutoImageDir, c.PlutoCacheDir = "/srv/images", "/srv/images/" }, true},
+		{"cache in images", func(c *Config) { c.PlutoImageDir, c.PlutoCacheDir = "/srv/images", "/srv/images/cache" }, true},
+		{"images in cache", func(c *Config) { c.PlutoImageDir, c.PlutoCacheDir = "/srv/cache/images", "/srv/cache" }, true},
+		{"both empty", func(c *Config) {}, true},
+		{"s3 default", func(c *Config) { c.PlutoStorage = StorageS3 }, false},
+		{"s3 empty image prefix", func(c *Config) { c.PlutoStorage, c.PlutoS3ImagePrefix = StorageS3, "" }, true},
+		{"s3 same prefix", func(c *Config) {
+			c.PlutoStorage, c.PlutoS3ImagePrefix, c.PlutoS3CachePrefix = StorageS3, "pluto/", "pluto/"
+		}, true},
+		{"s3 nested prefix", func(c *Config) {
+			c.PlutoStorage, c.PlutoS3ImagePrefix, c.PlutoS3CachePrefix = StorageS3, "images", "images-cache/"
+		}, true},
+	}
+	for _, tt := range tests {
+		config := DefaultConfig()
+		tt.config(&config)
+		if err := checkStorageLocations(config); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkStorageLocations() = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFileStage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewFileStorage(t.TempDir())
+	exists := func(key string) bool {
+		_, err := storage.Stat(ctx, key)
+		return err == nil
+	}
+
+	_ = storage.Put(ctx, "old.jpg", []byte("old"), "image/jpeg")
+	stage := newFileStage(storage)
+	_ = stage.Put(ctx, "new.jpg", []byte("new"), "image/jpeg")
+	stage.Supersede("old.jpg")
+	if exists("new.jpg") {
+		t.Fatal("staged file visible before Promote")
+	}
+	if err := stage.Promote(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("new.jpg") || !exists("old.jpg") {
+		t.Fatal("Promote must move the staged file and keep the superseded one")
+	}
+	stage.Commit(ctx)
+	if !exists("new.jpg") || exists("old.jpg") {
+		t.Error("Commit must delete the superseded file only")
+	}
+
+	// A rollback after Promote removes the promoted files, the superseded stay
+	_ = storage.Put(ctx, "old.jpg", []byte("old"), "image/jpeg")
+	stage = newFileStage(storage)
+	_ = stage.Put(ctx, "rolled.jpg", []byte("new"), "image/jpeg")
+	_ = stage.Put(ctx, "staged.jpg", []byte("new"), "image/jpeg")
+	stage.Supersede("old.jpg")
+	_ = stage.Promote(ctx)
+	stage.Rollback(ctx)
+	if exists("rolled.jpg") || exists("staged.jpg") || !exists("old.jpg") {
+		t.Error("Rollback must remove the promoted files and keep the superseded one")
+	}
+	objects, _ := storage.List(ctx, stagingPrefix)
+	if len(objects) > 0 {
+		t.Errorf("Rollback left staging files: %v", objects)
+	}
+}
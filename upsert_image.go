@@ -2,22 +2,21 @@ package pluto
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image"
 	"io"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
-	"github.com/chai2010/webp"
-	"github.com/disintegration/imaging"
-	"github.com/gen2brain/avif"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/rwcarlsen/goexif/exif"
+	"github.com/sndcds/grains/grains_api"
 	"github.com/sndcds/grains/grains_file"
 	"github.com/sndcds/grains/grains_uuid"
 )
@@ -28,9 +27,101 @@ type UpsertImageResult struct {
 	FileRemovedFlag   bool
 	CacheFilesRemoved int
 	ImageUuid         string
+	DeduplicatedFlag  bool // an identical image existed and was linked instead
 }
 
-func UpsertImage(
+// API: POST/PUT /image/:context/:contextUuid/:identifier
+func (pluto *Pluto) putImageByContext(gc *gin.Context) {
+	apiRequest := grains_api.NewRequest(gc, "put-pluto-image")
+
+	context, contextUuid, identifier := gc.Param("context"), gc.Param("contextUuid"), gc.Param("identifier")
+	userUuid, ok := pluto.authorizeWrite(gc, apiRequest, ActionUpload, context, contextUuid, identifier)
+	if !ok {
+		return
+	}
+
+	result, err := pluto.UpsertImage(gc, context, contextUuid, identifier, nil, userUuid, nil)
+	if err != nil {
+		writeResultError(apiRequest, result.HttpStatus, result.Message, err)
+		return
+	}
+
+	apiRequest.Success(result.HttpStatus, ImageWriteResponse{
+		ImageUuid:         result.ImageUuid,
+		FileRemoved:       result.FileRemovedFlag,
+		CacheFilesRemoved: result.CacheFilesRemoved,
+		Deduplicated:      result.DeduplicatedFlag,
+	}, result.Message)
+}
+
+// authorizeWrite resolves the user and consults the Authorizer for the link, it writes the error response if denied
+func (pluto *Pluto) authorizeWrite(
+	gc *gin.Context,
+	apiRequest *grains_api.Request,
+	action Action,
+	context string,
+	contextUuid string,
+	identifier string,
+) (string, bool) {
+	if err := validateUuid(contextUuid); err != nil {
+		apiRequest.Error(http.StatusBadRequest, "invalid contextUuid")
+		return "", false
+	}
+
+	userUuid, ok := pluto.resolveUser(gc, apiRequest)
+	if !ok {
+		return "", false
+	}
+
+	imageUuid, ok := pluto.GetImageUuidByByContext(gc, context, contextUuid, identifier)
+	if !ok {
+		apiRequest.DatabaseError()
+		return "", false
+	}
+
+	link := ImageLink{
+		ImageUuid:   imageUuid,
+		Context:     context,
+		ContextUuid: contextUuid,
+		Identifier:  identifier,
+		UserUuid:    userUuid,
+	}
+	if !pluto.authorize(gc, apiRequest, action, link) {
+		return "", false
+	}
+
+	return userUuid, true
+}
+
+// resolveUser returns the uuid of the requesting user, it writes the error response if unauthenticated
+func (pluto *Pluto) resolveUser(gc *gin.Context, apiRequest *grains_api.Request) (string, bool) {
+	if pluto.ResolveUser == nil {
+		apiRequest.Error(http.StatusUnauthorized, "authentication required")
+		return "", false
+	}
+	userUuid, err := pluto.ResolveUser(gc)
+	if err != nil || userUuid == "" {
+		apiRequest.Error(http.StatusUnauthorized, "authentication required")
+		return "", false
+	}
+	return userUuid, true
+}
+
+// writeResultError answers a failed write, the message of a client error is passed on,
+// server errors are logged and answered generically as they may contain database or storage details
+func writeResultError(apiRequest *grains_api.Request, status int, message string, err error) {
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	if status < http.StatusInternalServerError {
+		apiRequest.Error(status, message)
+		return
+	}
+	fmt.Printf("Error: %v\n", err)
+	apiRequest.Error(status, http.StatusText(status))
+}
+
+func (pluto *Pluto) UpsertImage(
 	gc *gin.Context,
 	context string,
 	contextUuid string,
@@ -40,16 +131,17 @@ func UpsertImage(
 	postCallback TxFunc,
 ) (UpsertImageResult, error) {
 	ctx := gc.Request.Context()
-	dbSchema := PlutoInstance.DbSchema
+	dbSchema := pluto.DbSchema
 
-	maxUploadSize := PlutoInstance.Config.PlutoMaxImageSize
-	maxWidth := PlutoInstance.Config.PlutoMaxImagePx
-	maxHeight := PlutoInstance.Config.PlutoMaxImagePx
-	compressionQuality := PlutoInstance.Config.PlutoDefaultQuality
+	maxUploadSize := pluto.Config.PlutoMaxImageSize
+	maxWidth := pluto.Config.PlutoMaxImagePx
+	maxHeight := pluto.Config.PlutoMaxImagePx
+	compressionQuality := pluto.Config.PlutoDefaultQuality
 
 	var result UpsertImageResult
 	genFileName := ""
 	prevGenFileName := ""
+	var prevOriginalGenFileName *string
 	deleteCacheImageUuid := ""
 
 	payloadStr := gc.PostForm("payload")
@@ -77,22 +169,29 @@ func UpsertImage(
 
 	imageUuid := ""
 	insertImageFlag := false
+	sharedImageUuid := ""
+	releasedImageUuid := ""
+	var releasedFileNames []string
+
+	// New files get their final names at the end of the transaction
+	stage := newFileStage(pluto.ImageStorage)
 
-	txErr := WithTransaction(ctx, PlutoInstance.DbPool, func(tx pgx.Tx) *ApiTxError {
+	txErr := WithTransaction(ctx, pluto.DbPool, func(tx pgx.Tx) *ApiTxError {
 		// Check context/identifier rules
 		var contextMaxWidth *int
 		var contextMaxHeight *int
 		var contextMaxFileSize *int64
 		var contextCompression *int
+		var contextDeduplicate bool
 		contextRuleFound := true
 		query := fmt.Sprintf(
-			`SELECT max_width, max_height, max_file_size, compression
+			`SELECT max_width, max_height, max_file_size, compression, deduplicate
 		         FROM %s.pluto_context_rules
         		 WHERE context = $1 AND identifier = $2`,
-			PlutoInstance.DbSchema,
+			pluto.DbSchema,
 		)
 		err := tx.QueryRow(ctx, query, context, identifier).Scan(
-			&contextMaxWidth, &contextMaxHeight, &contextMaxFileSize, &contextCompression)
+			&contextMaxWidth, &contextMaxHeight, &contextMaxFileSize, &contextCompression, &contextDeduplicate)
 		if err != nil {
 			if errors.Is(err, pgx.ErrNoRows) {
 				contextRuleFound = false
@@ -124,7 +223,7 @@ func UpsertImage(
 			`SELECT pluto_image_uuid
 		         FROM %s.pluto_image_link
         		 WHERE context = $1 AND context_uuid = $2::uuid AND identifier = $3`,
-			PlutoInstance.DbSchema,
+			pluto.DbSchema,
 		)
 
 		err = tx.QueryRow(ctx, query, context, contextUuid, identifier).Scan(&imageUuid)
@@ -139,6 +238,7 @@ func UpsertImage(
 				}
 			}
 		}
+		linkedImageUuid := imageUuid
 
 		file, err := gc.FormFile("file")
 		if file != nil {
@@ -152,6 +252,22 @@ func UpsertImage(
 						float64(file.Size)/(1<<20))}
 			}
 
+			// A shared image is copied on write, the other links keep showing it
+			if imageUuid != "" {
+				linkCount, err := pluto.imageLinkCountTx(ctx, tx, imageUuid)
+				if err != nil {
+					return &ApiTxError{
+						Code: http.StatusInternalServerError,
+						Err:  fmt.Errorf("Failed to count image links: %v", err),
+					}
+				}
+				if linkCount > 1 {
+					sharedImageUuid = imageUuid
+					imageUuid = ""
+					insertImageFlag = true
+				}
+			}
+
 			// Read file into buffer for multiple uses
 			buf := new(bytes.Buffer)
 			src, err := file.Open()
@@ -181,212 +297,322 @@ func UpsertImage(
 			fmt.Printf("mimeType: %s\n", mimeType)
 			fmt.Printf("isAVIF: %t\n", isAVIF)
 
-			// Decode EXIF metadata if present
-			exifData := make(map[string]string)
-			x, err := exif.Decode(bytes.NewReader(buf.Bytes()))
-			if err == nil {
-				x.Walk(&exifWalker{m: exifData})
+			// Keep the untouched upload, the master below is derived from it
+			originalBytes := buf.Bytes()
+			originalChecksum := fmt.Sprintf("%x", sha256.Sum256(originalBytes))
+			originalMimeType := mimeType
+			if isAVIF {
+				originalMimeType = "image/avif"
 			}
 
-			var img image.Image
-			switch {
-			case isAVIF:
-				img, err = avif.Decode(bytes.NewReader(buf.Bytes()))
-				mimeType = "image/webp"
-			case mimeType == "image/webp":
-				img, err = webp.Decode(bytes.NewReader(buf.Bytes()))
-			default:
-				img, _, err = image.Decode(bytes.NewReader(buf.Bytes()))
-			}
-
-			if err != nil {
-				return &ApiTxError{
-					Code: http.StatusBadRequest,
-					Err:  errors.New("Invalid image"),
+			// Identical uploads share one image if the context rule asks for it
+			if contextDeduplicate {
+				duplicateUuid, err := pluto.findImageByChecksumTx(gc, tx, originalChecksum)
+				if err != nil {
+					return &ApiTxError{
+						Code: http.StatusInternalServerError,
+						Err:  fmt.Errorf("Failed to find duplicate image: %v", err),
+					}
 				}
-			}
-
-			imageWidth := img.Bounds().Dx()
-			imageHeight := img.Bounds().Dy()
-
-			// Downscale if needed
-			if imageWidth > maxWidth || imageHeight > maxHeight {
-				img = imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
-			}
-			// Encode back into buffer (overwrite original!)
-			buf.Reset()
-
-			var fileExt string
-			switch mimeType {
-			case "image/png":
-				err = imaging.Encode(buf, img, imaging.PNG)
-				fileExt = ".png"
-			case "image/jpeg":
-				err = imaging.Encode(buf, img, imaging.JPEG, imaging.JPEGQuality(compressionQuality))
-				fileExt = ".jpg"
-			case "image/webp":
-				fmt.Printf("eoncode as webp\n")
-				err = webp.Encode(buf, img, &webp.Options{
-					Quality: float32(compressionQuality),
-				})
-				fileExt = ".webp"
-			default:
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  errors.New("Unsupported image format"),
+				if duplicateUuid != "" {
+					imageUuid = duplicateUuid
+					insertImageFlag = false
+					result.DeduplicatedFlag = true
+					result.Message = "Image deduplicated"
 				}
 			}
 
-			fmt.Printf("fileExt: %s\n", fileExt)
-
-			if err != nil {
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  errors.New("Image encoding failed"),
+			if !result.DeduplicatedFlag {
+				// Decode EXIF metadata if present
+				exifData := make(map[string]string)
+				x, err := exif.Decode(bytes.NewReader(buf.Bytes()))
+				if err == nil {
+					x.Walk(&exifWalker{m: exifData})
 				}
-			}
 
-			imageWidth = img.Bounds().Dx()
-			imageHeight = img.Bounds().Dy()
+				// Decoding and encoding share the render limit with getImage
+				release, err := pluto.renderLimiter.Acquire(ctx)
+				if err != nil {
+					if errors.Is(err, ErrRenderOverloaded) {
+						gc.Header("Retry-After", pluto.renderLimiter.RetryAfter())
+						return &ApiTxError{
+							Code: http.StatusServiceUnavailable,
+							Err:  err,
+						}
+					}
+					return &ApiTxError{
+						Code: http.StatusRequestTimeout,
+						Err:  errors.New("Upload cancelled"),
+					}
+				}
+				release = sync.OnceFunc(release)
+				defer release()
 
-			// Generate uuid if neccessary
-			if imageUuid == "" {
-				imageUuid, err = grains_uuid.Uuidv7String()
+				master, err := pluto.normalizeImage(originalBytes, originalMimeType, maxWidth, maxHeight, compressionQuality)
 				if err != nil {
+					switch {
+					case errors.Is(err, errInvalidImage):
+						return &ApiTxError{
+							Code: http.StatusBadRequest,
+							Err:  err,
+						}
+					case errors.Is(err, errUnsupportedFormat):
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  err,
+						}
+					}
 					return &ApiTxError{
 						Code: http.StatusInternalServerError,
-						Err:  errors.New("Failed to generate uuid"),
+						Err:  errors.New("Image encoding failed"),
 					}
 				}
-			}
-
-			// Sanitize and generate filename
-			originalFileName := filepath.Base(file.Filename)
-			genFileName = fmt.Sprintf("%s%s", imageUuid, fileExt)
-
-			if err != nil {
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  fmt.Errorf("Failed to generate filename: %v", err),
+				release()
+
+				mimeType = master.MimeType
+				fileExt := master.FileExt
+				imageWidth := master.Width
+				imageHeight := master.Height
+
+				// Generate uuid if neccessary
+				if imageUuid == "" {
+					imageUuid, err = grains_uuid.Uuidv7String()
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  errors.New("Failed to generate uuid"),
+						}
+					}
 				}
-			}
 
-			// Ensure upload directory exists
-			imageDir := PlutoInstance.Config.PlutoImageDir
-			if err := os.MkdirAll(imageDir, os.ModePerm); err != nil {
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  fmt.Errorf("Failed to create directory: %v", err),
+				// A replacement gets the next version, the replaced files may stay in the history
+				version := 1
+				if !insertImageFlag {
+					version, err = pluto.nextImageVersionTx(ctx, tx, imageUuid)
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  fmt.Errorf("Failed to get image version: %v", err),
+						}
+					}
 				}
-			}
 
-			if fileNamePrefix != nil {
-				genFileName = fmt.Sprintf("%s_%s", *fileNamePrefix, genFileName)
-			}
+				// Sanitize and generate filename
+				originalFileName := filepath.Base(file.Filename)
+				genFileName = fmt.Sprintf("%s%s", imageUuid, fileExt)
+				if version > 1 {
+					genFileName = fmt.Sprintf("%s_v%d%s", imageUuid, version, fileExt)
+				}
 
-			savePath := filepath.Join(imageDir, genFileName)
-			err = os.WriteFile(savePath, buf.Bytes(), 0644)
-			if err != nil {
-				return &ApiTxError{
-					Code: http.StatusInternalServerError,
-					Err:  fmt.Errorf("Failed to save file: %v", err),
+				if fileNamePrefix != nil {
+					genFileName = fmt.Sprintf("%s_%s", *fileNamePrefix, genFileName)
 				}
-			}
 
-			if insertImageFlag {
-				// Insert new pluto image
-				query := fmt.Sprintf(`
-					INSERT INTO %s.pluto_image (uuid, file_name, gen_file_name, width, height, mime_type, exif, created_by)
-					VALUES ($1::uuid, $2, $3, $4, $5, $6, $7, $8::uuid) RETURNING uuid`,
-					dbSchema)
-
-				_, err = tx.Exec(
-					ctx, query,
-					imageUuid,
-					originalFileName,
-					genFileName,
-					imageWidth,
-					imageHeight,
-					mimeType,
-					exifData,
-					userUuid)
+				err = stage.Put(ctx, genFileName, master.Data, mimeType)
 				if err != nil {
 					return &ApiTxError{
 						Code: http.StatusInternalServerError,
-						Err:  fmt.Errorf("Failed to insert pluto image: %v", err),
+						Err:  fmt.Errorf("Failed to save file: %v", err),
 					}
 				}
-				result.Message = "Image inserted successfully"
-			} else {
-				err := validateUuid(imageUuid)
+
+				originalGenFileName := strings.TrimSuffix(genFileName, fileExt) + "_original" + imageFileExt(originalMimeType)
+				err = stage.Put(ctx, originalGenFileName, originalBytes, originalMimeType)
 				if err != nil {
 					return &ApiTxError{
 						Code: http.StatusInternalServerError,
-						Err:  fmt.Errorf("Invalid uuid: %s, %v", imageUuid, err),
+						Err:  fmt.Errorf("Failed to save original file: %v", err),
 					}
 				}
 
-				// Update existing pluto image
-				query := fmt.Sprintf(`
-WITH image AS (SELECT gen_file_name FROM %s.pluto_image WHERE uuid = $1::uuid)
-UPDATE %s.pluto_image SET file_name = $2, gen_file_name = $3, width = $4, height = $5, mime_type = $6, exif = $7
-FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name
-					`, dbSchema, dbSchema, dbSchema)
-
-				err = tx.QueryRow(
-					ctx, query,
-					imageUuid,
-					originalFileName,
-					genFileName,
-					imageWidth,
-					imageHeight,
-					mimeType,
-					exifData,
-				).Scan(&prevGenFileName)
+				if insertImageFlag {
+					// Insert new pluto image
+					query := fmt.Sprintf(`
+						INSERT INTO %s.pluto_image (uuid, file_name, gen_file_name, width, height, mime_type, exif, created_by,
+							original_gen_file_name, original_checksum, original_size, original_mime_type, phash, uploaded_by)
+						VALUES ($1::uuid, $2, $3, $4, $5, $6, $7, $8::uuid, $9, $10, $11, $12, $13, $8::uuid) RETURNING uuid`,
+						dbSchema)
+
+					_, err = tx.Exec(
+						ctx, query,
+						imageUuid,
+						originalFileName,
+						genFileName,
+						imageWidth,
+						imageHeight,
+						mimeType,
+						exifData,
+						userUuid,
+						originalGenFileName,
+						originalChecksum,
+						len(originalBytes),
+						originalMimeType,
+						int64(master.PHash))
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  fmt.Errorf("Failed to insert pluto image: %v", err),
+						}
+					}
+					result.Message = "Image inserted successfully"
+
+					if sharedImageUuid != "" {
+						// Keep the fields the payload does not carry
+						query := fmt.Sprintf(
+							`UPDATE %s.pluto_image SET expiration_date = shared.expiration_date
+							 FROM %s.pluto_image shared
+							 WHERE %s.pluto_image.uuid = $1::uuid AND shared.uuid = $2::uuid`,
+							dbSchema, dbSchema, dbSchema)
+						if _, err := tx.Exec(ctx, query, imageUuid, sharedImageUuid); err != nil {
+							return &ApiTxError{
+								Code: http.StatusInternalServerError,
+								Err:  fmt.Errorf("Failed to copy shared pluto image: %v", err),
+							}
+						}
+						result.Message = "Shared image copied on write"
+					}
+				} else {
+					err := validateUuid(imageUuid)
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  fmt.Errorf("Invalid uuid: %s, %v", imageUuid, err),
+						}
+					}
+
+					// Keep the replaced master in the history
+					archived := pluto.Config.PlutoVersionsKeep > 0
+					if archived {
+						if err := pluto.archiveImageVersionTx(ctx, tx, imageUuid, userUuid); err != nil {
+							return &ApiTxError{
+								Code: http.StatusInternalServerError,
+								Err:  fmt.Errorf("Failed to archive pluto image: %v", err),
+							}
+						}
+					}
+
+					// Update existing pluto image
+					query := fmt.Sprintf(`
+	WITH image AS (SELECT gen_file_name, original_gen_file_name FROM %s.pluto_image WHERE uuid = $1::uuid)
+	UPDATE %s.pluto_image SET file_name = $2, gen_file_name = $3, width = $4, height = $5, mime_type = $6, exif = $7,
+		original_gen_file_name = $8, original_checksum = $9, original_size = $10, original_mime_type = $11,
+		phash = $12, version = $13, uploaded_by = NULLIF($14, '')::uuid, uploaded_at = now()
+	FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name, image.original_gen_file_name
+						`, dbSchema, dbSchema, dbSchema)
+
+					err = tx.QueryRow(
+						ctx, query,
+						imageUuid,
+						originalFileName,
+						genFileName,
+						imageWidth,
+						imageHeight,
+						mimeType,
+						exifData,
+						originalGenFileName,
+						originalChecksum,
+						len(originalBytes),
+						originalMimeType,
+						int64(master.PHash),
+						version,
+						userUuid,
+					).Scan(&prevGenFileName, &prevOriginalGenFileName)
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  fmt.Errorf("Failed to update pluto image: %v", err),
+						}
+					}
+
+					if archived {
+						// The history owns the replaced files now, pruned versions go after the commit
+						prevGenFileName = ""
+						prevOriginalGenFileName = nil
+						prunedFileNames, err := pluto.pruneImageVersionsTx(ctx, tx, imageUuid)
+						if err != nil {
+							return &ApiTxError{
+								Code: http.StatusInternalServerError,
+								Err:  fmt.Errorf("Failed to prune image versions: %v", err),
+							}
+						}
+						stage.Supersede(prunedFileNames...)
+					}
+					result.Message = "image updated successfully"
+					deleteCacheImageUuid = imageUuid
+				}
+			}
+		}
+
+		// A deduplicated upload links an existing image, its metadata is left to the
+		// links it already has
+		keepMeta := result.DeduplicatedFlag && imageUuid != linkedImageUuid
+
+		// Metadata belongs to the image, a shared one is copied on write, so the
+		// other links keep theirs
+		if (file == nil || result.DeduplicatedFlag) && imageUuid != "" && !keepMeta {
+			linkCount, err := pluto.imageLinkCountTx(ctx, tx, imageUuid)
+			if err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Failed to count image links: %v", err),
+				}
+			}
+			if linkCount > 1 {
+				changed, err := pluto.imageMetaChangedTx(ctx, tx, imageUuid, meta)
 				if err != nil {
 					return &ApiTxError{
 						Code: http.StatusInternalServerError,
-						Err:  fmt.Errorf("Failed to update pluto image: %v", err),
+						Err:  fmt.Errorf("Failed to compare image metadata: %v", err),
 					}
 				}
-				result.Message = "image updated successfully"
-				deleteCacheImageUuid = imageUuid
+				if changed {
+					imageUuid, err = pluto.copyImageTx(ctx, tx, stage, imageUuid, fileNamePrefix, userUuid)
+					if err != nil {
+						return &ApiTxError{
+							Code: http.StatusInternalServerError,
+							Err:  fmt.Errorf("Failed to copy shared pluto image: %v", err),
+						}
+					}
+					result.Message = "Shared image copied on write"
+				}
 			}
 		}
 
-		// Check if cached images must be removed, if focus point changes
-		prevFocusX, prevFocusY, err := GetImageFocusTx(ctx, tx, imageUuid)
-		if err != nil {
-			return &ApiTxError{
-				Code: http.StatusInternalServerError,
-				Err:  fmt.Errorf("Get focus failed: %v", err),
+		if !keepMeta {
+			// Check if cached images must be removed, if focus point changes
+			prevFocusX, prevFocusY, err := pluto.GetImageFocusTx(ctx, tx, imageUuid)
+			if err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Get focus failed: %v", err),
+				}
+			}
+			if !FloatPtrEqual(focusX, prevFocusX) || !FloatPtrEqual(focusY, prevFocusY) {
+				deleteCacheImageUuid = imageUuid
 			}
-		}
-		if !FloatPtrEqual(focusX, prevFocusX) || !FloatPtrEqual(focusY, prevFocusY) {
-			deleteCacheImageUuid = imageUuid
-		}
-
-		query = fmt.Sprintf(
-			`UPDATE %s.pluto_image
-			SET alt_text = $1, copyright = $2, creator_name = $3, license = $4, description = $5, focus_x = $6, focus_y = $7
-			WHERE uuid = $8`,
-			dbSchema)
 
-		// Update pluto_image
-		_, err = tx.Exec(
-			ctx, query,
-			altText,
-			copyright,
-			creatorName,
-			license,
-			description,
-			focusX,
-			focusY,
-			imageUuid)
-		if err != nil {
-			return &ApiTxError{
-				Code: http.StatusInternalServerError,
-				Err:  fmt.Errorf("Update pluto_image failed: %v", err),
+			query = fmt.Sprintf(
+				`UPDATE %s.pluto_image
+				SET alt_text = $1, copyright = $2, creator_name = $3, license = $4, description = $5, focus_x = $6, focus_y = $7
+				WHERE uuid = $8`,
+				dbSchema)
+
+			// Update pluto_image
+			_, err = tx.Exec(
+				ctx, query,
+				altText,
+				copyright,
+				creatorName,
+				license,
+				description,
+				focusX,
+				focusY,
+				imageUuid)
+			if err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Update pluto_image failed: %v", err),
+				}
 			}
 		}
 
@@ -398,7 +624,7 @@ FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name
 			ON CONFLICT (context, context_uuid, identifier)
 			DO UPDATE SET
 				pluto_image_uuid = EXCLUDED.pluto_image_uuid`,
-			PlutoInstance.DbSchema)
+			pluto.DbSchema)
 
 		_, err = tx.Exec(
 			ctx,
@@ -415,6 +641,18 @@ FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name
 			}
 		}
 
+		// The image the link showed before goes with its last link
+		if linkedImageUuid != "" && linkedImageUuid != imageUuid {
+			releasedFileNames, err = pluto.releaseImageTx(ctx, tx, linkedImageUuid)
+			if err != nil {
+				return &ApiTxError{
+					Code: http.StatusInternalServerError,
+					Err:  fmt.Errorf("Failed to release pluto_image: %v", err),
+				}
+			}
+			releasedImageUuid = linkedImageUuid
+		}
+
 		// Call the callback inside the transaction
 		if postCallback != nil {
 			if err := postCallback(ctx, tx); err != nil {
@@ -425,20 +663,45 @@ FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name
 			}
 		}
 
+		// The files get their final names last, before the new rows become visible
+		if err := stage.Promote(ctx); err != nil {
+			return &ApiTxError{
+				Code: http.StatusInternalServerError,
+				Err:  fmt.Errorf("Failed to store image files: %v", err),
+			}
+		}
+
 		return nil
 	})
+	// Finish the files even if the client has gone
+	stageCtx := contextWithoutCancel(ctx)
 	if txErr != nil {
+		stage.Rollback(stageCtx)
 		result.HttpStatus = txErr.Code
 		result.Message = txErr.Err.Error()
 		return result, txErr.Err
 	}
 
+	if prevOriginalGenFileName != nil {
+		stage.Supersede(prevGenFileName, *prevOriginalGenFileName)
+	} else {
+		stage.Supersede(prevGenFileName)
+	}
+	stage.Commit(stageCtx)
+
 	// Filesystem cleanup (post-commit)
-	cleanup, err := CleanupPlutoImageFiles(deleteCacheImageUuid, "")
+	cleanup, err := pluto.CleanupPlutoImageFiles(deleteCacheImageUuid, "")
 	if err == nil {
 		result.CacheFilesRemoved = cleanup.CacheFilesRemoved
 		result.FileRemovedFlag = cleanup.ImageFileRemoved
 	}
+	if len(releasedFileNames) > 0 {
+		cleanup, err := pluto.CleanupPlutoImageFiles(releasedImageUuid, releasedFileNames...)
+		if err == nil {
+			result.CacheFilesRemoved += cleanup.CacheFilesRemoved
+			result.FileRemovedFlag = result.FileRemovedFlag || cleanup.ImageFileRemoved
+		}
+	}
 
 	result.HttpStatus = http.StatusOK
 	result.ImageUuid = imageUuid
@@ -446,6 +709,23 @@ FROM image WHERE %s.pluto_image.uuid = $1::uuid RETURNING image.gen_file_name
 	return result, nil
 }
 
+// imageFileExt returns the file extension for an image MIME type
+func imageFileExt(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/avif":
+		return ".avif"
+	}
+	return ".bin"
+}
+
 func validateUuid(u string) error {
 	if _, err := uuid.Parse(u); err != nil {
 		return fmt.Errorf("Invalid UUID: %s", u)
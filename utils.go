@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"math"
 	"os"
@@ -17,10 +18,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
 	"github.com/nfnt/resize"
+	"github.com/sndcds/grains/grains_uuid"
 )
 
 const eps = 1e-5
 
+// maxDuplicateCandidates limits the images with the same checksum checked for read access
+const maxDuplicateCandidates = 10
+
 func ParamInt(gc *gin.Context, key string) (int, bool) {
 	str := gc.Param(key)
 	val, err := strconv.Atoi(str)
@@ -249,6 +254,95 @@ func CropWithFocusWithoutAlpha(
 	return cropped
 }
 
+// fitBox resolves the target box for the non-cropping fit modes. Missing edges
+// are derived from targetRatio or, if not set, from the source aspect ratio.
+// Without any edge the smallest box with targetRatio enclosing the source is used.
+func fitBox(srcW, srcH int, targetRatio float32, targetW, targetH int) (int, int) {
+	if targetRatio <= eps {
+		targetRatio = float32(srcW) / float32(srcH)
+	}
+
+	switch {
+	case targetW > 0 && targetH > 0:
+		return targetW, targetH
+	case targetW > 0:
+		return targetW, max(1, int(float32(targetW)/targetRatio))
+	case targetH > 0:
+		return max(1, int(float32(targetH)*targetRatio)), targetH
+	}
+
+	if float32(srcW)/float32(srcH) > targetRatio {
+		return srcW, max(1, int(float32(srcW)/targetRatio))
+	}
+	return max(1, int(float32(srcH)*targetRatio)), srcH
+}
+
+// ContainImage scales an image down so that it fits completely into the target box
+// and centers it on a canvas of exactly the box size, filled with background
+// (CSS object-fit: contain).
+func ContainImage(
+	img image.Image,
+	targetRatio float32,
+	targetW, targetH int,
+	background color.Color,
+) image.Image {
+	boxW, boxH := fitBox(img.Bounds().Dx(), img.Bounds().Dy(), targetRatio, targetW, targetH)
+	scaled := FitInside(img, targetRatio, boxW, boxH)
+	canvas := imaging.New(boxW, boxH, background)
+	return imaging.OverlayCenter(canvas, scaled, 1.0)
+}
+
+// FillImage stretches an image to exactly the target box, ignoring its aspect ratio
+// (CSS object-fit: fill).
+func FillImage(img image.Image, targetRatio float32, targetW, targetH int) image.Image {
+	boxW, boxH := fitBox(img.Bounds().Dx(), img.Bounds().Dy(), targetRatio, targetW, targetH)
+	if boxW == img.Bounds().Dx() && boxH == img.Bounds().Dy() {
+		return img
+	}
+	return imaging.Resize(img, boxW, boxH, imaging.Lanczos)
+}
+
+// FitInside scales an image down, preserving its aspect ratio, so that both edges
+// are less than or equal to the target box. Images are never enlarged.
+func FitInside(img image.Image, targetRatio float32, targetW, targetH int) image.Image {
+	boxW, boxH := fitBox(img.Bounds().Dx(), img.Bounds().Dy(), targetRatio, targetW, targetH)
+	return imaging.Fit(img, boxW, boxH, imaging.Lanczos)
+}
+
+// FitOutside scales an image down, preserving its aspect ratio, so that both edges
+// are greater than or equal to the target box. Images are never enlarged.
+func FitOutside(img image.Image, targetRatio float32, targetW, targetH int) image.Image {
+	srcW := img.Bounds().Dx()
+	srcH := img.Bounds().Dy()
+	boxW, boxH := fitBox(srcW, srcH, targetRatio, targetW, targetH)
+
+	scale := math.Max(float64(boxW)/float64(srcW), float64(boxH)/float64(srcH))
+	if scale >= 1 {
+		return img
+	}
+
+	finalW := max(1, int(math.Round(float64(srcW)*scale)))
+	finalH := max(1, int(math.Round(float64(srcH)*scale)))
+	return imaging.Resize(img, finalW, finalH, imaging.Lanczos)
+}
+
+// ParseHexColor parses colors like "fff", "ffffff" or "ffffff80", with or without
+// a leading '#'.
+func ParseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return color.NRGBA{}, errors.New("Invalid color")
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+}
+
 func clampNormalized(v float32) float32 {
 	if v < 0.0 {
 		return 0.0
@@ -296,74 +390,62 @@ type ImageCleanupResult struct {
 	ImageFileRemoved  bool
 }
 
-func CleanupPlutoImageFiles(imageUuid string, fileName string) (*ImageCleanupResult, error) {
+func (pluto *Pluto) CleanupPlutoImageFiles(imageUuid string, fileNames ...string) (*ImageCleanupResult, error) {
 	result := &ImageCleanupResult{}
 
 	// Always clean cache (safe even if image doesn't exist)
-	cacheFilesRemoved, err := CleanupPlutoCache(imageUuid)
+	cacheFilesRemoved, err := pluto.CleanupPlutoCache(imageUuid)
 	if err != nil {
 		return result, err
 	}
 	result.CacheFilesRemoved = cacheFilesRemoved
 
-	// Only clean image file if we actually have a filename
-	if fileName != "" {
-		imageFileRemoved, err := CleanupPlutoImage(fileName)
+	// Only clean image files if we actually have a filename
+	for _, fileName := range fileNames {
+		if fileName == "" {
+			continue
+		}
+		imageFileRemoved, err := pluto.CleanupPlutoImage(fileName)
 		if err != nil {
 			return result, err
 		}
-		result.ImageFileRemoved = imageFileRemoved
+		result.ImageFileRemoved = result.ImageFileRemoved || imageFileRemoved
 	}
 
 	return result, nil
 }
 
 // Delete original image file
-func CleanupPlutoImage(imageFileName string) (bool, error) {
+func (pluto *Pluto) CleanupPlutoImage(imageFileName string) (bool, error) {
 	if imageFileName != "" {
-		path := filepath.Join(PlutoInstance.Config.PlutoImageDir, imageFileName)
-		if err := RemoveFile(path); err != nil {
-			return false, err
+		if err := pluto.ImageStorage.Delete(context.Background(), imageFileName); err != nil {
+			return false, fmt.Errorf("Failed to delete file %s: %w", imageFileName, err)
 		}
 	}
 	return true, nil
 }
 
-// Delete cache files
-func CleanupPlutoCache(imageUuid string) (int, error) {
+// Delete cache files and their pluto_cache rows
+func (pluto *Pluto) CleanupPlutoCache(imageUuid string) (int, error) {
+	ctx := context.Background()
 	prefix := fmt.Sprintf("%s_", imageUuid)
-	cacheFilesRemoved, err := DeleteFilesWithPrefix(PlutoInstance.Config.PlutoCacheDir, prefix)
+	cacheFilesRemoved, err := DeleteStorageWithPrefix(ctx, pluto.CacheStorage, prefix)
 	if err != nil {
 		return 0, err
 	}
+
+	query := fmt.Sprintf(`DELETE FROM %s.pluto_cache WHERE starts_with(receipt, $1)`, pluto.DbSchema)
+	if _, err := pluto.DbPool.Exec(ctx, query, prefix); err != nil {
+		return cacheFilesRemoved, err
+	}
+
 	return cacheFilesRemoved, nil
 }
 
 // DeleteFilesWithPrefix deletes all files in a directory that start with the given prefix.
 // Returns the number of deleted files and an error (if any).
 func DeleteFilesWithPrefix(dir string, prefix string) (int, error) {
-	if len(prefix) < 1 {
-		return 0, errors.New("Prefix required")
-	}
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return 0, fmt.Errorf("Failed to read directory: %w", err)
-	}
-	deletedCount := 0
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		name := entry.Name()
-		if strings.HasPrefix(name, prefix) {
-			fullPath := filepath.Join(dir, name)
-			if err := os.Remove(fullPath); err != nil {
-				return deletedCount, fmt.Errorf("Failed to delete %s: %w", fullPath, err)
-			}
-			deletedCount++
-		}
-	}
-	return deletedCount, nil
+	return DeleteStorageWithPrefix(context.Background(), NewFileStorage(dir), prefix)
 }
 
 // RemoveFile deletes a file at the given path.
@@ -386,7 +468,7 @@ func RemoveFile(path string) error {
 }
 
 // GetImageFocus returns focus_x and focus_y for an image
-func GetImageFocusTx(
+func (pluto *Pluto) GetImageFocusTx(
 	ctx context.Context,
 	tx pgx.Tx,
 	imageUuid string,
@@ -394,7 +476,7 @@ func GetImageFocusTx(
 
 	query := fmt.Sprintf(
 		`SELECT focus_x, focus_y FROM %s.pluto_image WHERE uuid = $1::uuid`,
-		PlutoInstance.DbSchema,
+		pluto.DbSchema,
 	)
 
 	var fx, fy *float64
@@ -407,15 +489,15 @@ func GetImageFocusTx(
 }
 
 // Deletes image + cache DB entries, returns filename to delete from disk
-func DeleteImageTx(
+func (pluto *Pluto) DeleteImageTx(
 	ctx context.Context,
 	tx pgx.Tx,
 	imageUuid string,
 ) (deletedFileName string, cacheRows int64, err error) {
-	schema := PlutoInstance.DbSchema
+	schema := pluto.DbSchema
 
 	// Delete cache rows
-	cacheRowsAffected, err := DeleteCacheTx(ctx, tx, imageUuid)
+	cacheRowsAffected, err := pluto.DeleteCacheTx(ctx, tx, imageUuid)
 	if err != nil {
 		return "", 0, err
 	}
@@ -430,13 +512,228 @@ func DeleteImageTx(
 	return deletedFileName, cacheRowsAffected, nil
 }
 
+// lockImageTx locks the row of an image until the transaction ends, pgx.ErrNoRows is
+// returned if the image does not exist.
+func (pluto *Pluto) lockImageTx(ctx context.Context, tx pgx.Tx, imageUuid string) error {
+	query := fmt.Sprintf(`SELECT 1 FROM %s.pluto_image WHERE uuid = $1::uuid FOR UPDATE`, pluto.DbSchema)
+	var locked int
+	return tx.QueryRow(ctx, query, imageUuid).Scan(&locked)
+}
+
+// imageLinkCountTx locks an image and counts its links. The lock serializes the
+// transactions linking and releasing the same image.
+func (pluto *Pluto) imageLinkCountTx(ctx context.Context, tx pgx.Tx, imageUuid string) (int, error) {
+	if err := pluto.lockImageTx(ctx, tx, imageUuid); err != nil {
+		return 0, err
+	}
+
+	var linkCount int
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s.pluto_image_link WHERE pluto_image_uuid = $1::uuid`, pluto.DbSchema)
+	if err := tx.QueryRow(ctx, query, imageUuid).Scan(&linkCount); err != nil {
+		return 0, err
+	}
+
+	return linkCount, nil
+}
+
+// findImageByChecksumTx locks the oldest image whose original has the checksum and
+// the caller may read, the uuid is empty if there is none.
+func (pluto *Pluto) findImageByChecksumTx(gc *gin.Context, tx pgx.Tx, checksum string) (string, error) {
+	ctx := gc.Request.Context()
+	query := fmt.Sprintf(
+		`SELECT uuid::text FROM %s.pluto_image
+		 WHERE original_checksum = $1
+		 ORDER BY created_at, uuid
+		 LIMIT %d`,
+		pluto.DbSchema, maxDuplicateCandidates)
+	rows, err := tx.Query(ctx, query, checksum)
+	if err != nil {
+		return "", err
+	}
+	candidates, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return "", err
+	}
+
+	// Uploads must not reveal or link images hidden from the uploader
+	for _, imageUuid := range candidates {
+		allowed, err := pluto.allowImage(gc, ActionRead, imageUuid)
+		if err != nil {
+			return "", err
+		}
+		if !allowed {
+			continue
+		}
+		err = pluto.lockImageTx(ctx, tx, imageUuid)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			return "", err
+		}
+		return imageUuid, nil
+	}
+	return "", nil
+}
+
+// releaseImageTx deletes an image and its cache rows once no link refers to it anymore.
+// It returns the files to delete after the commit, none while the image is still linked.
+func (pluto *Pluto) releaseImageTx(ctx context.Context, tx pgx.Tx, imageUuid string) ([]string, error) {
+	linkCount, err := pluto.imageLinkCountTx(ctx, tx, imageUuid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if linkCount > 0 {
+		return nil, nil
+	}
+
+	if _, err := pluto.DeleteCacheTx(ctx, tx, imageUuid); err != nil {
+		return nil, err
+	}
+
+	// The history goes with the image, its rows by cascade
+	var fileNames []string
+	query := fmt.Sprintf(
+		`SELECT gen_file_name, COALESCE(original_gen_file_name, '')
+		 FROM %s.pluto_image_version WHERE pluto_image_uuid = $1::uuid`,
+		pluto.DbSchema)
+	rows, err := tx.Query(ctx, query, imageUuid)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var genFileName, originalGenFileName string
+		if err := rows.Scan(&genFileName, &originalGenFileName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fileNames = append(fileNames, genFileName, originalGenFileName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var genFileName, originalGenFileName string
+	query = fmt.Sprintf(
+		`DELETE FROM %s.pluto_image WHERE uuid = $1::uuid
+		 RETURNING COALESCE(gen_file_name, ''), COALESCE(original_gen_file_name, '')`,
+		pluto.DbSchema)
+	if err := tx.QueryRow(ctx, query, imageUuid).Scan(&genFileName, &originalGenFileName); err != nil {
+		return nil, err
+	}
+
+	return append(fileNames, genFileName, originalGenFileName), nil
+}
+
+// imageMetaChangedTx reports whether the metadata of a payload differs from the stored one
+func (pluto *Pluto) imageMetaChangedTx(ctx context.Context, tx pgx.Tx, imageUuid string, meta ImageMeta) (bool, error) {
+	var stored ImageMeta
+	query := fmt.Sprintf(
+		`SELECT alt_text, copyright, creator_name, license, description, focus_x, focus_y
+		 FROM %s.pluto_image WHERE uuid = $1::uuid`,
+		pluto.DbSchema)
+	err := tx.QueryRow(ctx, query, imageUuid).Scan(
+		&stored.AltText, &stored.Copyright, &stored.Creator, &stored.License, &stored.Description,
+		&stored.FocusX, &stored.FocusY)
+	if err != nil {
+		return false, err
+	}
+
+	changed := !StringPtrEqual(meta.AltText, stored.AltText) ||
+		!StringPtrEqual(meta.Copyright, stored.Copyright) ||
+		!StringPtrEqual(meta.Creator, stored.Creator) ||
+		!StringPtrEqual(meta.License, stored.License) ||
+		!StringPtrEqual(meta.Description, stored.Description) ||
+		!FloatPtrEqual(meta.FocusX, stored.FocusX) ||
+		!FloatPtrEqual(meta.FocusY, stored.FocusY)
+	return changed, nil
+}
+
+// copyImageTx copies an image with its master and original into a new image and
+// returns its uuid. The files are staged, the history stays with the source image.
+func (pluto *Pluto) copyImageTx(
+	ctx context.Context,
+	tx pgx.Tx,
+	stage *fileStage,
+	imageUuid string,
+	fileNamePrefix *string,
+	userUuid string,
+) (string, error) {
+	var genFileName, mimeType, originalGenFileName, originalMimeType string
+	query := fmt.Sprintf(
+		`SELECT COALESCE(gen_file_name, ''), COALESCE(mime_type, ''),
+		        COALESCE(original_gen_file_name, ''), COALESCE(original_mime_type, '')
+		 FROM %s.pluto_image WHERE uuid = $1::uuid`,
+		pluto.DbSchema)
+	err := tx.QueryRow(ctx, query, imageUuid).Scan(&genFileName, &mimeType, &originalGenFileName, &originalMimeType)
+	if err != nil {
+		return "", err
+	}
+
+	copyUuid, err := grains_uuid.Uuidv7String()
+	if err != nil {
+		return "", err
+	}
+	namePrefix := copyUuid
+	if fileNamePrefix != nil {
+		namePrefix = *fileNamePrefix + "_" + copyUuid
+	}
+
+	copyGenFileName := ""
+	if genFileName != "" {
+		copyGenFileName = namePrefix + filepath.Ext(genFileName)
+		if err := stageCopy(ctx, pluto.ImageStorage, stage, genFileName, copyGenFileName, mimeType); err != nil {
+			return "", err
+		}
+	}
+	var copyOriginalGenFileName *string
+	if originalGenFileName != "" {
+		name := namePrefix + "_original" + filepath.Ext(originalGenFileName)
+		if err := stageCopy(ctx, pluto.ImageStorage, stage, originalGenFileName, name, originalMimeType); err != nil {
+			return "", err
+		}
+		copyOriginalGenFileName = &name
+	}
+
+	query = fmt.Sprintf(
+		`INSERT INTO %s.pluto_image (uuid, file_name, gen_file_name, width, height, mime_type, exif,
+			alt_text, description, license, expiration_date, creator_name, copyright, focus_x, focus_y,
+			created_by, original_gen_file_name, original_checksum, original_size, original_mime_type,
+			phash, uploaded_by, uploaded_at)
+		 SELECT $1::uuid, file_name, NULLIF($2, ''), width, height, mime_type, exif,
+			alt_text, description, license, expiration_date, creator_name, copyright, focus_x, focus_y,
+			NULLIF($3, '')::uuid, $4, original_checksum, original_size, original_mime_type,
+			phash, uploaded_by, uploaded_at
+		 FROM %s.pluto_image WHERE uuid = $5::uuid`,
+		pluto.DbSchema, pluto.DbSchema)
+	_, err = tx.Exec(ctx, query, copyUuid, copyGenFileName, userUuid, copyOriginalGenFileName, imageUuid)
+	if err != nil {
+		return "", err
+	}
+
+	return copyUuid, nil
+}
+
+// stageCopy stages a copy of a stored file under another key
+func stageCopy(ctx context.Context, storage Storage, stage *fileStage, key string, copyKey string, contentType string) error {
+	data, err := storage.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %w", key, err)
+	}
+	return stage.Put(ctx, copyKey, data, contentType)
+}
+
 // Deletes cache DB entries, return number of affected rows
-func DeleteCacheTx(
+func (pluto *Pluto) DeleteCacheTx(
 	ctx context.Context,
 	tx pgx.Tx,
 	imageUuid string,
 ) (deletedFilesCount int64, err error) {
-	schema := PlutoInstance.DbSchema
+	schema := pluto.DbSchema
 
 	cacheQuery := fmt.Sprintf(`DELETE FROM %s.pluto_cache WHERE pluto_image_uuid = $1::uuid`, schema)
 	cmdTag, err := tx.Exec(ctx, cacheQuery, imageUuid)
@@ -447,6 +744,18 @@ func DeleteCacheTx(
 	return cmdTag.RowsAffected(), nil
 }
 
+// StringPtrEqual compares two optional strings, nil equals the empty string
+func StringPtrEqual(a, b *string) bool {
+	var sa, sb string
+	if a != nil {
+		sa = *a
+	}
+	if b != nil {
+		sb = *b
+	}
+	return sa == sb
+}
+
 func FloatPtrEqual(a, b *float64) bool {
 	if a == nil && b == nil {
 		return true
@@ -0,0 +1,51 @@
+package pluto
+
+import "testing"
+
+func TestFitBox(t *testing.T) {
+	tests := []struct {
+		name         string
+		srcW, srcH   int
+		ratio        float32
+		targetW      int
+		targetH      int
+		wantW, wantH int
+	}{
+		{"both edges", 1000, 500, 0, 300, 300, 300, 300},
+		{"width, source ratio", 1000, 500, 0, 300, 0, 300, 150},
+		{"height, source ratio", 1000, 500, 0, 0, 100, 200, 100},
+		{"width, target ratio", 1000, 500, 1, 300, 0, 300, 300},
+		{"height, target ratio", 1000, 500, 0.5, 0, 400, 200, 400},
+		{"no edge, wider source", 1000, 500, 1, 0, 0, 1000, 1000},
+		{"no edge, taller source", 500, 1000, 1, 0, 0, 1000, 1000},
+		{"no edge, no ratio", 1000, 500, 0, 0, 0, 1000, 500},
+		{"tiny", 1000, 10, 0, 10, 0, 10, 1},
+	}
+	for _, tt := range tests {
+		w, h := fitBox(tt.srcW, tt.srcH, tt.ratio, tt.targetW, tt.targetH)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestParseAspectRatio(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    float32
+		wantErr bool
+	}{
+		{"16:9", 16.0 / 9, false},
+		{"1.5:1", 1.5, false},
+		{"1.5", 0, true},
+		{"2:1", 2, false},
+		{"x", 0, true},
+		{"1:0", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAspectRatio(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseAspectRatio(%q) = %g, %v, want %g", tt.s, got, err, tt.want)
+		}
+	}
+}